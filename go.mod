@@ -5,8 +5,10 @@ go 1.24.3
 toolchain go1.24.4
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/luna-page/luna v0.1.5
 	github.com/shirou/gopsutil/v4 v4.25.4
+	golang.org/x/net v0.41.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,279 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAggregateInterval = 10 * time.Second
+	defaultAggregateTimeout  = 5 * time.Second
+)
+
+const (
+	fleetAgentStatusOK    = "ok"
+	fleetAgentStatusStale = "stale"
+	fleetAgentStatusDown  = "down"
+)
+
+type aggregateConfig struct {
+	// Downstream agents to poll, aggregate mode is disabled when empty
+	Agents   []aggregateAgentConfig `yaml:"agents"`
+	Interval time.Duration          `yaml:"interval"`
+	// Applies to each agent separately so that a dead one doesn't hold up the rest
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type aggregateAgentConfig struct {
+	// Identifies the agent in the fleet endpoints, e.g. /api/v1/fleet/{name}/sysinfo/all
+	Name  string `yaml:"name"`
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+func (c *aggregateConfig) validate() error {
+	if c.Interval < 0 || c.Timeout < 0 {
+		return errors.New("aggregate.interval and aggregate.timeout can't be negative")
+	}
+
+	names := make(map[string]bool, len(c.Agents))
+
+	for i, a := range c.Agents {
+		if a.Name == "" || strings.ContainsAny(a.Name, "/?#%") {
+			return fmt.Errorf("aggregate.agents[%d]: name must be set and can't contain any of / ? # %%", i)
+		}
+
+		if names[a.Name] {
+			return fmt.Errorf("aggregate.agents[%d]: duplicate name %q", i, a.Name)
+		}
+		names[a.Name] = true
+
+		u, err := url.Parse(a.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("aggregate.agents[%d]: url must be an http or https URL, got %q", i, a.URL)
+		}
+	}
+
+	return nil
+}
+
+// Polls a fleet of downstream agents, each on its own schedule, and keeps
+// their latest responses so that they can be served without waiting on them
+type aggregator struct {
+	interval time.Duration
+	client   *http.Client
+	agents   []*fleetAgent
+	byName   map[string]*fleetAgent
+}
+
+type fleetAgent struct {
+	name  string
+	url   string
+	token string
+
+	mu        sync.Mutex
+	info      *apiSystemInfo
+	updatedAt time.Time
+	err       error
+}
+
+func newAggregator(config *aggregateConfig) *aggregator {
+	a := &aggregator{
+		interval: config.Interval,
+		client:   &http.Client{Timeout: config.Timeout},
+		byName:   make(map[string]*fleetAgent, len(config.Agents)),
+	}
+
+	if a.interval == 0 {
+		a.interval = defaultAggregateInterval
+	}
+
+	if a.client.Timeout == 0 {
+		a.client.Timeout = defaultAggregateTimeout
+	}
+
+	for _, c := range config.Agents {
+		agent := &fleetAgent{
+			name:  c.Name,
+			url:   strings.TrimSuffix(c.URL, "/") + "/api/sysinfo/all",
+			token: c.Token,
+		}
+		a.agents = append(a.agents, agent)
+		a.byName[agent.name] = agent
+	}
+
+	return a
+}
+
+func (a *aggregator) run(ctx context.Context) {
+	slog.Info("Aggregating agents", "count", len(a.agents), "interval", a.interval)
+
+	for _, agent := range a.agents {
+		go a.poll(ctx, agent)
+	}
+}
+
+func (a *aggregator) poll(ctx context.Context, agent *fleetAgent) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		info, err := a.fetch(ctx, agent)
+		if ctx.Err() != nil {
+			return
+		}
+
+		agent.mu.Lock()
+		wasFailing := agent.err != nil
+		agent.err = err
+		if err == nil {
+			agent.info = info
+			agent.updatedAt = time.Now()
+		}
+		agent.mu.Unlock()
+
+		if err != nil && !wasFailing {
+			slog.Warn("Could not poll agent", "name", agent.name, "error", err)
+		} else if err == nil && wasFailing {
+			slog.Info("Polling agent succeeded again", "name", agent.name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *aggregator) fetch(ctx context.Context, agent *fleetAgent) (*apiSystemInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, agent.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", "luna-agent/"+buildVersion)
+	if agent.token != "" {
+		req.Header.Set("Authorization", "Bearer "+agent.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// Decoding can't allocate the embedded struct because it's unexported
+	info := &apiSystemInfo{apiHostInfo: &apiHostInfo{}}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return info, nil
+}
+
+func (agent *fleetAgent) snapshot() apiFleetAgentInfo {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	info := apiFleetAgentInfo{
+		Name:    agent.name,
+		Sysinfo: agent.info,
+	}
+
+	switch {
+	case agent.err == nil && agent.info != nil:
+		info.Status = fleetAgentStatusOK
+	case agent.info != nil:
+		info.Status = fleetAgentStatusStale
+	default:
+		info.Status = fleetAgentStatusDown
+	}
+
+	if agent.err != nil {
+		info.Error = agent.err.Error()
+	}
+
+	if !agent.updatedAt.IsZero() {
+		info.UpdatedAt = agent.updatedAt.Unix()
+	}
+
+	return info
+}
+
+func (a *aggregator) endpoints() []endpoint {
+	findAgent := func(w http.ResponseWriter, r *http.Request) (apiFleetAgentInfo, time.Time, bool) {
+		agent, exists := a.byName[r.PathValue("name")]
+		if !exists {
+			http.NotFound(w, r)
+			return apiFleetAgentInfo{}, time.Time{}, false
+		}
+
+		info := agent.snapshot()
+		if info.Sysinfo == nil {
+			http.Error(w, "Agent has not responded yet: "+info.Error, http.StatusBadGateway)
+			return info, time.Time{}, false
+		}
+
+		return info, time.Unix(info.UpdatedAt, 0), true
+	}
+
+	return []endpoint{
+		{"GET " + apiPrefix + "/fleet", func(w http.ResponseWriter, r *http.Request) {
+			fleet := apiFleetInfo{Agents: make([]apiFleetAgentInfo, len(a.agents))}
+			for i, agent := range a.agents {
+				fleet.Agents[i] = agent.snapshot()
+			}
+
+			writeJSON(w, fleet)
+		}},
+		{"GET " + apiPrefix + "/fleet/{name}/sysinfo/all", func(w http.ResponseWriter, r *http.Request) {
+			info, updatedAt, ok := findAgent(w, r)
+			if !ok || checkNotModified(w, r, updatedAt, a.interval) {
+				return
+			}
+
+			writeJSON(w, info.Sysinfo)
+		}},
+		{"GET " + apiPrefix + "/fleet/{name}/sysinfo/{section}", func(w http.ResponseWriter, r *http.Request) {
+			section := findSection(r.PathValue("section"))
+			if section == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			info, updatedAt, ok := findAgent(w, r)
+			if !ok || checkNotModified(w, r, updatedAt, a.interval) {
+				return
+			}
+
+			writeJSON(w, section.value(info.Sysinfo))
+		}},
+		{"GET " + apiPrefix + "/fleet/{name}/healthz", func(w http.ResponseWriter, r *http.Request) {
+			agent, exists := a.byName[r.PathValue("name")]
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+
+			if agent.snapshot().Status != fleetAgentStatusOK {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		}},
+	}
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregatorWithAnAgentDown(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/sysinfo/all" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		io.WriteString(w, `{"host_info_is_available":true,"hostname":"nas","memory":{"is_available":true,"used_percent":42}}`)
+	}))
+	defer up.Close()
+
+	// Nothing listens on the address of a closed server, so polling it fails right away
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	aggregator := newAggregator(&aggregateConfig{
+		Agents: []aggregateAgentConfig{
+			{Name: "nas", URL: up.URL + "/", Token: "secret"},
+			{Name: "offline", URL: down.URL},
+		},
+		Interval: time.Hour,
+		Timeout:  time.Second,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator.run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for aggregator.byName["nas"].snapshot().Status != fleetAgentStatusOK || aggregator.byName["offline"].snapshot().Error == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the agents to be polled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mux := http.NewServeMux()
+	for _, e := range aggregator.endpoints() {
+		mux.HandleFunc(e.pattern, e.handler)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get(apiPrefix + "/fleet")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("fleet responded with %d", rec.Code)
+	}
+
+	// Decoded separately since apiSystemInfo can't be decoded into when nested
+	var fleet struct {
+		Agents []struct {
+			Name      string         `json:"name"`
+			Status    string         `json:"status"`
+			Error     string         `json:"error"`
+			UpdatedAt int64          `json:"updated_at"`
+			Sysinfo   map[string]any `json:"sysinfo"`
+		} `json:"agents"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fleet); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fleet.Agents) != 2 {
+		t.Fatalf("expected 2 agents, got %d", len(fleet.Agents))
+	}
+
+	nas, offline := fleet.Agents[0], fleet.Agents[1]
+	if nas.Name != "nas" || nas.Status != fleetAgentStatusOK || nas.Error != "" || nas.UpdatedAt == 0 || nas.Sysinfo["hostname"] != "nas" {
+		t.Errorf("unexpected first agent %+v", nas)
+	}
+	if offline.Name != "offline" || offline.Status != fleetAgentStatusDown || offline.Error == "" || offline.UpdatedAt != 0 || offline.Sysinfo != nil {
+		t.Errorf("unexpected second agent %+v", offline)
+	}
+
+	if rec := get(apiPrefix + "/fleet/nas/sysinfo/memory"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"used_percent":42`) {
+		t.Errorf("unexpected memory section response %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := get(apiPrefix + "/fleet/offline/sysinfo/all"); rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), offline.Error) {
+		t.Errorf("expected a 502 with the poll error for the agent that is down, got %d %s", rec.Code, rec.Body)
+	}
+
+	for path, want := range map[string]int{
+		apiPrefix + "/fleet/nas/healthz":             http.StatusOK,
+		apiPrefix + "/fleet/offline/healthz":         http.StatusServiceUnavailable,
+		apiPrefix + "/fleet/missing/sysinfo/all":     http.StatusNotFound,
+		apiPrefix + "/fleet/nas/sysinfo/nonexistent": http.StatusNotFound,
+	} {
+		if rec := get(path); rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package agent
+
+const apiVersion = "v1"
+const apiPrefix = "/api/" + apiVersion
+
+// The types below define the JSON returned by the versioned API and the OpenAPI document
+// is generated from them, with descriptions taken from the doc tags. New fields may be
+// added, however existing fields must not be renamed, removed or change type without
+// introducing a new API version.
+//
+// Sections are left out of the response when they weren't requested, see sections.go
+
+type apiSystemInfo struct {
+	*apiHostInfo
+
+	CPU         *apiCPUInfo          `json:"cpu,omitzero"`
+	Memory      *apiMemoryInfo       `json:"memory,omitzero"`
+	Mountpoints []apiMountpointInfo  `json:"mountpoints,omitzero" doc:"Visible mountpoints, ordered by used percentage from highest to lowest"`
+	ZFS         []apiZFSPoolInfo     `json:"zfs,omitzero" doc:"Imported ZFS pools, empty if ZFS isn't in use"`
+	RAID        []apiRAIDArrayInfo   `json:"raid,omitzero" doc:"mdadm arrays followed by Btrfs filesystems spanning multiple devices"`
+	SMART       []apiSMARTDeviceInfo `json:"smart,omitzero" doc:"SMART data of disks, empty unless enabled in the config"`
+	Sensors     []apiSensorInfo      `json:"sensors,omitzero" doc:"Temperature, fan, voltage and power sensors from hwmon, empty when not on Linux"`
+	Power       *apiPowerInfo        `json:"power,omitzero"`
+	UPS         []apiUPSInfo         `json:"ups,omitzero" doc:"UPSes from Network UPS Tools, empty unless enabled in the config"`
+}
+
+type apiHostInfo struct {
+	HostInfoIsAvailable bool   `json:"host_info_is_available" doc:"Whether hostname, platform and boot time could be retrieved"`
+	BootTime            int64  `json:"boot_time" doc:"Unix timestamp of when the host booted"`
+	Hostname            string `json:"hostname"`
+	Platform            string `json:"platform" doc:"Name of the OS or distribution, e.g. debian"`
+}
+
+type apiCPUInfo struct {
+	LoadIsAvailable bool  `json:"load_is_available"`
+	Load1Percent    uint8 `json:"load1_percent" doc:"1 minute load average relative to the core count, capped at 100"`
+	Load15Percent   uint8 `json:"load15_percent" doc:"15 minute load average relative to the core count, capped at 100"`
+
+	UtilizationIsAvailable bool  `json:"utilization_is_available"`
+	UtilizationPercent     uint8 `json:"utilization_percent" doc:"Share of time the CPU was busy across all cores since the section was previously collected"`
+
+	TemperatureIsAvailable bool   `json:"temperature_is_available"`
+	TemperatureC           uint8  `json:"temperature_c" doc:"CPU temperature in degrees Celsius"`
+	TemperatureSensor      string `json:"temperature_sensor" doc:"Key of the sensor the temperature was read from, either cpu-temp-sensor from the config or the one picked automatically, see agent sensors:print --explain"`
+}
+
+type apiMemoryInfo struct {
+	IsAvailable bool   `json:"memory_is_available"`
+	TotalMB     uint64 `json:"total_mb"`
+	UsedMB      uint64 `json:"used_mb"`
+	UsedPercent uint8  `json:"used_percent"`
+
+	SwapIsAvailable bool   `json:"swap_is_available"`
+	SwapTotalMB     uint64 `json:"swap_total_mb"`
+	SwapUsedMB      uint64 `json:"swap_used_mb"`
+	SwapUsedPercent uint8  `json:"swap_used_percent"`
+}
+
+type apiMountpointInfo struct {
+	Path        string `json:"path"`
+	Name        string `json:"name" doc:"Display name from the config, empty if not set"`
+	TotalMB     uint64 `json:"total_mb"`
+	UsedMB      uint64 `json:"used_mb"`
+	UsedPercent uint8  `json:"used_percent"`
+
+	InodesTotal       uint64 `json:"inodes_total" doc:"0 for filesystems that allocate inodes dynamically, such as Btrfs"`
+	InodesUsed        uint64 `json:"inodes_used"`
+	InodesUsedPercent uint8  `json:"inodes_used_percent"`
+
+	FSType   string `json:"fs_type" doc:"Type of the filesystem, e.g. ext4 or zfs"`
+	Device   string `json:"device" doc:"Device the filesystem is mounted from, e.g. /dev/sda1, or the name of the pool for collapsed ZFS datasets"`
+	ReadOnly bool   `json:"read_only"`
+
+	Network bool `json:"network" doc:"Whether the filesystem is mounted over the network, e.g. NFS or CIFS"`
+	Stale   bool `json:"stale" doc:"Whether the filesystem didn't respond in time or returned an error, in which case the usage is the last known one, or 0 if there is none"`
+}
+
+type apiZFSPoolInfo struct {
+	Name  string `json:"name"`
+	State string `json:"state" doc:"Health of the pool, e.g. ONLINE, DEGRADED or FAULTED"`
+
+	CapacityIsAvailable  bool   `json:"capacity_is_available" doc:"Whether the fields below could be retrieved through zpool, which isn't the case when only the state is known from the kernel module"`
+	SizeMB               uint64 `json:"size_mb" doc:"Raw size of the pool, including space used for parity"`
+	AllocatedMB          uint64 `json:"allocated_mb"`
+	FreeMB               uint64 `json:"free_mb"`
+	UsedPercent          uint8  `json:"used_percent"`
+	FragmentationPercent uint8  `json:"fragmentation_percent" doc:"Fragmentation of the free space"`
+
+	ScrubState   string           `json:"scrub_state" doc:"State of the last scrub or resilver: none, scrubbing, paused, finished, canceled, resilvering or resilvered, empty if unknown"`
+	ScrubErrors  uint64           `json:"scrub_errors" doc:"Errors found by the last scrub or resilver once finished"`
+	ScrubEndTime int64            `json:"scrub_end_time" doc:"Unix timestamp of when the last scrub or resilver finished or got canceled, 0 if it hasn't"`
+	Vdevs        []apiZFSVdevInfo `json:"vdevs" doc:"Virtual devices of the pool and the disks they're made of, in the order listed by zpool status"`
+}
+
+type apiZFSVdevInfo struct {
+	Name           string `json:"name" doc:"Name of the vdev or disk, e.g. mirror-0 or sda"`
+	State          string `json:"state"`
+	ReadErrors     uint64 `json:"read_errors"`
+	WriteErrors    uint64 `json:"write_errors"`
+	ChecksumErrors uint64 `json:"checksum_errors"`
+}
+
+type apiRAIDArrayInfo struct {
+	Name                string              `json:"name" doc:"Name of the md device, e.g. md0, or the label of the Btrfs filesystem, falling back to its UUID"`
+	Type                string              `json:"type" doc:"md or btrfs"`
+	Level               string              `json:"level" doc:"RAID level of an md array, e.g. raid1, or the data profile of a Btrfs filesystem"`
+	Active              bool                `json:"active" doc:"Whether an md array is running, always true for Btrfs"`
+	Degraded            bool                `json:"degraded" doc:"Whether fewer devices are active than the array is made of"`
+	DevicesTotal        int                 `json:"devices_total"`
+	DevicesActive       int                 `json:"devices_active"`
+	SyncAction          string              `json:"sync_action" doc:"resync, recovery, check, reshape or repair for md and balance or replace for Btrfs, empty when idle"`
+	SyncProgressPercent uint8               `json:"sync_progress_percent" doc:"Progress of the sync action, only known for md"`
+	Devices             []apiRAIDDeviceInfo `json:"devices"`
+}
+
+type apiRAIDDeviceInfo struct {
+	Name  string `json:"name" doc:"Block device of an md member, e.g. sda1, or the devid of a Btrfs device"`
+	State string `json:"state" doc:"active, faulty or spare for md and active or missing for Btrfs"`
+
+	ReadErrors       uint64 `json:"read_errors" doc:"Read errors, which for md are only those that got corrected"`
+	WriteErrors      uint64 `json:"write_errors" doc:"Only reported for Btrfs"`
+	FlushErrors      uint64 `json:"flush_errors" doc:"Only reported for Btrfs"`
+	CorruptionErrors uint64 `json:"corruption_errors" doc:"Checksum mismatches, only reported for Btrfs"`
+	GenerationErrors uint64 `json:"generation_errors" doc:"Blocks with an unexpected generation, only reported for Btrfs"`
+}
+
+type apiSMARTDeviceInfo struct {
+	Name      string `json:"name" doc:"Path of the device, e.g. /dev/sda"`
+	Protocol  string `json:"protocol" doc:"ATA, NVMe or SCSI"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial"`
+	Error     string `json:"error,omitempty" doc:"Why the SMART data couldn't be read, such as missing privileges"`
+	Standby   bool   `json:"standby" doc:"Whether the disk was in standby on the last attempt, in which case it wasn't woken up and the values are from when it was last read"`
+	UpdatedAt int64  `json:"updated_at" doc:"Unix timestamp of when the values were read, 0 if they never were"`
+
+	HealthIsAvailable bool `json:"health_is_available"`
+	Healthy           bool `json:"healthy" doc:"Whether the overall health self-assessment passed"`
+
+	TemperatureIsAvailable bool  `json:"temperature_is_available"`
+	TemperatureC           uint8 `json:"temperature_c"`
+
+	PowerOnHours       uint64 `json:"power_on_hours"`
+	ReallocatedSectors uint64 `json:"reallocated_sectors" doc:"Raw value of ATA attribute 5"`
+	PendingSectors     uint64 `json:"pending_sectors" doc:"Raw value of ATA attribute 197"`
+	NVMeUsedPercent    uint8  `json:"nvme_used_percent" doc:"Estimate of how much of the NVMe drive's life has been used, which can exceed 100"`
+	NVMeMediaErrors    uint64 `json:"nvme_media_errors" doc:"Unrecovered data integrity errors of the NVMe drive"`
+}
+
+type apiFleetInfo struct {
+	Agents []apiFleetAgentInfo `json:"agents" doc:"Downstream agents in the order they're configured in"`
+}
+
+type apiFleetAgentInfo struct {
+	Name      string         `json:"name"`
+	Status    string         `json:"status" doc:"ok if the last poll succeeded, stale if it failed but an earlier one didn't, down if none have succeeded yet"`
+	Error     string         `json:"error,omitempty" doc:"Why the last poll failed"`
+	UpdatedAt int64          `json:"updated_at,omitempty" doc:"Unix timestamp of the last successful poll"`
+	Sysinfo   *apiSystemInfo `json:"sysinfo" doc:"Response of the last successful poll, null if none have succeeded yet"`
+}
+
+type apiSensorInfo struct {
+	Key   string  `json:"key" doc:"Name of the chip followed by the sensor's label, or by its attribute such as temp1 when it has none, e.g. coretemp_package_id_0"`
+	Name  string  `json:"name" doc:"Display name from the config, empty if not set"`
+	Chip  string  `json:"chip" doc:"Name of the driver, e.g. coretemp or nct6798"`
+	Label string  `json:"label" doc:"Label from the driver, empty if it has none"`
+	Type  string  `json:"type" doc:"One of temperature, fan, voltage or power"`
+	Unit  string  `json:"unit" doc:"One of celsius, rpm, volts or watts, depending on the type"`
+	Value float64 `json:"value"`
+
+	MaxIsAvailable      bool    `json:"max_is_available"`
+	Max                 float64 `json:"max"`
+	CriticalIsAvailable bool    `json:"critical_is_available"`
+	Critical            float64 `json:"critical"`
+}
+
+type apiPowerInfo struct {
+	RAPL      []apiRAPLDomainInfo `json:"rapl" doc:"Power domains of the CPU from Intel RAPL, which AMD processors also support, empty when not available"`
+	Batteries []apiBatteryInfo    `json:"batteries" doc:"Empty for machines without a battery"`
+}
+
+type apiRAPLDomainInfo struct {
+	Name             string  `json:"name" doc:"Name of the domain, e.g. package-0, package-0/dram or psys"`
+	PowerIsAvailable bool    `json:"power_is_available" doc:"Whether the power could be calculated, which requires the energy counter to have been read in a previous collection"`
+	PowerW           float64 `json:"power_w" doc:"Average power drawn since the section was previously collected"`
+}
+
+type apiBatteryInfo struct {
+	Name     string `json:"name" doc:"Name of the battery, e.g. BAT0"`
+	Status   string `json:"status" doc:"One of charging, discharging, full, not charging or unknown"`
+	Charging bool   `json:"charging"`
+
+	CapacityIsAvailable bool  `json:"capacity_is_available"`
+	CapacityPercent     uint8 `json:"capacity_percent" doc:"Remaining charge of the battery"`
+
+	TimeRemainingIsAvailable bool   `json:"time_remaining_is_available" doc:"Whether the time remaining is known, which is only the case while charging or discharging"`
+	TimeRemainingSeconds     uint64 `json:"time_remaining_seconds" doc:"Time until the battery is empty while discharging, or full while charging"`
+
+	PowerIsAvailable bool    `json:"power_is_available"`
+	PowerW           float64 `json:"power_w" doc:"Power the battery is being charged or discharged at"`
+}
+
+type apiUPSInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description" doc:"Description from the config of upsd, empty if not set"`
+	Error       string `json:"error" doc:"Why the variables of the UPS couldn't be read, e.g. DATA-STALE when its driver lost contact with it, empty if they could"`
+
+	Status     string `json:"status" doc:"Status flags separated by spaces, e.g. OL CHRG"`
+	OnLine     bool   `json:"on_line" doc:"Whether the UPS is running on utility power, the OL flag"`
+	OnBattery  bool   `json:"on_battery" doc:"Whether the UPS is running on its battery, the OB flag"`
+	LowBattery bool   `json:"low_battery" doc:"Whether the battery is low, the LB flag, at which point the UPS's clients usually shut down"`
+
+	ChargeIsAvailable bool  `json:"charge_is_available"`
+	ChargePercent     uint8 `json:"charge_percent"`
+
+	RuntimeIsAvailable bool   `json:"runtime_is_available"`
+	RuntimeSeconds     uint64 `json:"runtime_seconds" doc:"Estimated time the battery lasts at the current load"`
+
+	LoadIsAvailable bool  `json:"load_is_available"`
+	LoadPercent     uint8 `json:"load_percent" doc:"Load as a percentage of the UPS's capacity, which can go above 100"`
+
+	InputVoltageIsAvailable bool    `json:"input_voltage_is_available"`
+	InputVoltage            float64 `json:"input_voltage"`
+}
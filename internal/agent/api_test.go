@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// Has every field set, including those that get left out when empty, so that
+// any change to the JSON encoding of the API shows up in the golden file
+func populatedSystemInfo() *apiSystemInfo {
+	return &apiSystemInfo{
+		apiHostInfo: &apiHostInfo{
+			HostInfoIsAvailable: true,
+			BootTime:            1760000000,
+			Hostname:            "nas",
+			Platform:            "debian",
+		},
+		CPU: &apiCPUInfo{
+			LoadIsAvailable:        true,
+			Load1Percent:           12,
+			Load15Percent:          8,
+			UtilizationIsAvailable: true,
+			UtilizationPercent:     23,
+			TemperatureIsAvailable: true,
+			TemperatureC:           47,
+			TemperatureSensor:      "coretemp_package_id_0",
+		},
+		Memory: &apiMemoryInfo{
+			IsAvailable:     true,
+			TotalMB:         32000,
+			UsedMB:          12000,
+			UsedPercent:     37,
+			SwapIsAvailable: true,
+			SwapTotalMB:     4096,
+			SwapUsedMB:      128,
+			SwapUsedPercent: 3,
+		},
+		Mountpoints: []apiMountpointInfo{{
+			Path:              "/mnt/backup",
+			Name:              "Backup",
+			TotalMB:           3815447,
+			UsedMB:            1144409,
+			UsedPercent:       29,
+			InodesTotal:       244195328,
+			InodesUsed:        1203,
+			InodesUsedPercent: 1,
+			FSType:            "nfs4",
+			Device:            "192.168.1.10:/backup",
+			ReadOnly:          true,
+			Network:           true,
+			Stale:             true,
+		}},
+		ZFS: []apiZFSPoolInfo{{
+			Name:                 "tank",
+			State:                "DEGRADED",
+			CapacityIsAvailable:  true,
+			SizeMB:               3815447,
+			AllocatedMB:          1144409,
+			FreeMB:               2671038,
+			UsedPercent:          29,
+			FragmentationPercent: 12,
+			ScrubState:           "finished",
+			ScrubErrors:          3,
+			ScrubEndTime:         1759627587,
+			Vdevs: []apiZFSVdevInfo{{
+				Name:           "sda",
+				State:          "ONLINE",
+				ReadErrors:     2,
+				WriteErrors:    1,
+				ChecksumErrors: 3,
+			}},
+		}},
+		RAID: []apiRAIDArrayInfo{{
+			Name:                "md0",
+			Type:                "md",
+			Level:               "raid1",
+			Active:              true,
+			Degraded:            true,
+			DevicesTotal:        2,
+			DevicesActive:       1,
+			SyncAction:          "recovery",
+			SyncProgressPercent: 42,
+			Devices: []apiRAIDDeviceInfo{{
+				Name:             "sda1",
+				State:            "active",
+				ReadErrors:       1,
+				WriteErrors:      2,
+				FlushErrors:      3,
+				CorruptionErrors: 4,
+				GenerationErrors: 5,
+			}},
+		}},
+		SMART: []apiSMARTDeviceInfo{{
+			Name:                   "/dev/sda",
+			Protocol:               "ATA",
+			Model:                  "WDC WD40EFRX-68N32N0",
+			Serial:                 "WD-WCC7K1234567",
+			Error:                  "smartctl timed out",
+			Standby:                true,
+			UpdatedAt:              1760000000,
+			HealthIsAvailable:      true,
+			Healthy:                true,
+			TemperatureIsAvailable: true,
+			TemperatureC:           34,
+			PowerOnHours:           28102,
+			ReallocatedSectors:     8,
+			PendingSectors:         2,
+			NVMeUsedPercent:        3,
+			NVMeMediaErrors:        1,
+		}},
+		Sensors: []apiSensorInfo{{
+			Key:                 "nct6798_fan2",
+			Name:                "CPU fan",
+			Chip:                "nct6798",
+			Label:               "fan2",
+			Type:                sensorTypeFan,
+			Unit:                "rpm",
+			Value:               1180,
+			MaxIsAvailable:      true,
+			Max:                 2400,
+			CriticalIsAvailable: true,
+			Critical:            2600,
+		}},
+		Power: &apiPowerInfo{
+			RAPL: []apiRAPLDomainInfo{{
+				Name:             "package-0",
+				PowerIsAvailable: true,
+				PowerW:           14.25,
+			}},
+			Batteries: []apiBatteryInfo{{
+				Name:                     "BAT0",
+				Status:                   "discharging",
+				Charging:                 false,
+				CapacityIsAvailable:      true,
+				CapacityPercent:          81,
+				TimeRemainingIsAvailable: true,
+				TimeRemainingSeconds:     9000,
+				PowerIsAvailable:         true,
+				PowerW:                   7.5,
+			}},
+		},
+		UPS: []apiUPSInfo{{
+			Name:                    "rack",
+			Description:             "Rack UPS",
+			Error:                   "DATA-STALE",
+			Status:                  "OB LB",
+			OnLine:                  false,
+			OnBattery:               true,
+			LowBattery:              true,
+			ChargeIsAvailable:       true,
+			ChargePercent:           18,
+			RuntimeIsAvailable:      true,
+			RuntimeSeconds:          240,
+			LoadIsAvailable:         true,
+			LoadPercent:             37,
+			InputVoltageIsAvailable: true,
+			InputVoltage:            230.5,
+		}},
+	}
+}
+
+func TestSystemInfoJSONMatchesGolden(t *testing.T) {
+	got, err := json.MarshalIndent(populatedSystemInfo(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", "sysinfo.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("JSON of the system info doesn't match %s, which means the API changed. "+
+			"If that was intended, run go test -run %s -update and check the diff.\ngot:\n%s", path, t.Name(), got)
+	}
+}
+
+func TestOpenAPISchemaCoversSystemInfo(t *testing.T) {
+	golden, err := os.ReadFile(filepath.Join("testdata", "sysinfo.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value any
+	if err := json.Unmarshal(golden, &value); err != nil {
+		t.Fatal(err)
+	}
+
+	// Round trip the document so that it's made of the same types as the golden file
+	var document map[string]any
+	documentJSON, err := openAPIDocumentJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(documentJSON, &document); err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := document["components"].(map[string]any)["schemas"].(map[string]any)
+	paths := document["paths"].(map[string]any)
+
+	schema := paths[apiPrefix+"/sysinfo/all"].(map[string]any)["get"].(map[string]any)["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	checkOpenAPISchema(t, "sysinfo", value, schema, schemas)
+}
+
+// Checks that a JSON value only has the properties its schema describes, with matching types,
+// and that the golden file has every property of the schema so that none go unchecked
+func checkOpenAPISchema(t *testing.T, path string, value any, schema map[string]any, schemas map[string]any) {
+	t.Helper()
+
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := schemas[name].(map[string]any)
+		if !ok {
+			t.Errorf("%s: schema %s doesn't exist", path, ref)
+			return
+		}
+		schema = resolved
+	}
+
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, s := range allOf {
+			checkOpenAPISchema(t, path, value, s.(map[string]any), schemas)
+		}
+		return
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			t.Errorf("%s: expected an object, got %T", path, value)
+			return
+		}
+
+		properties, _ := schema["properties"].(map[string]any)
+		for name, v := range object {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s.%s is missing from the OpenAPI schema", path, name)
+				continue
+			}
+			checkOpenAPISchema(t, path+"."+name, v, property, schemas)
+		}
+
+		for name := range properties {
+			if _, ok := object[name]; !ok {
+				t.Errorf("%s.%s is in the OpenAPI schema but not in the golden file", path, name)
+			}
+		}
+
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				t.Errorf("%s.%s is required by the OpenAPI schema but missing", path, name)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			t.Errorf("%s: expected an array, got %T", path, value)
+			return
+		}
+		if len(array) == 0 {
+			t.Errorf("%s: expected the golden file to have at least one item", path)
+		}
+		for _, item := range array {
+			checkOpenAPISchema(t, path+"[]", item, schema["items"].(map[string]any), schemas)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			t.Errorf("%s: expected a string, got %T", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			t.Errorf("%s: expected a boolean, got %T", path, value)
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			t.Errorf("%s: expected a number, got %T", path, value)
+		}
+	default:
+		t.Errorf("%s: unexpected schema %v", path, schema)
+	}
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sets the validator and freshness headers for a response built from data collected at
+// the given time. Returns true if the client's cached copy is still current, in which
+// case a 304 response has already been written and nothing else should be.
+func checkNotModified(w http.ResponseWriter, r *http.Request, collectedAt time.Time, interval time.Duration) bool {
+	// Weak since the body differs depending on the negotiated compression
+	etag := `W/"` + strconv.FormatInt(collectedAt.UnixNano(), 36) + `"`
+	// The data gets replaced once the next collection completes
+	maxAge := math.Ceil(max(interval-time.Since(collectedAt), 0).Seconds())
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", collectedAt.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge)))
+
+	// If-Modified-Since must be ignored when If-None-Match is present
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagListContains(ifNoneMatch, etag) {
+			return false
+		}
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil || collectedAt.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Uses weak comparison as is required for If-None-Match
+func etagListContains(list string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for candidate := range strings.SplitSeq(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/shirou/gopsutil/v4/sensors"
@@ -15,11 +16,14 @@ const (
 	cliIntentServe        cliIntent = iota
 	cliIntentInstall                = iota
 	cliIntentPrintSensors           = iota
+	cliIntentDiscover               = iota
 )
 
 type cliOptions struct {
 	intent     cliIntent
 	configPath string
+	// Whether sensors:print should explain how the CPU temperature sensor is picked
+	explain bool
 }
 
 func parseCliOptions() (*cliOptions, error) {
@@ -32,7 +36,8 @@ func parseCliOptions() (*cliOptions, error) {
 
 		fmt.Println("\nCommands:")
 		fmt.Println("  install        Install the agent as a systemd service (Linux + systemd)")
-		fmt.Println("  sensors:print  List all sensors")
+		fmt.Println("  sensors:print  List all sensors, add --explain to show how the CPU temperature sensor is picked")
+		fmt.Println("  discover       Find agents on the local network and print their luna.yml entries")
 	}
 	configPath := flags.String("config", "agent.yml", "Set config path")
 	err := flags.Parse(os.Args[1:])
@@ -41,17 +46,29 @@ func parseCliOptions() (*cliOptions, error) {
 	}
 
 	var intent cliIntent
+	var explain bool
 	var args = flags.Args()
 	unknownCommandErr := fmt.Errorf("unknown command: %s", strings.Join(args, " "))
 
 	if len(args) == 0 {
 		intent = cliIntentServe
+	} else if args[0] == "sensors:print" {
+		intent = cliIntentPrintSensors
+
+		sensorsFlags := flag.NewFlagSet("sensors:print", flag.ExitOnError)
+		sensorsFlags.BoolVar(&explain, "explain", false, "Show how the CPU temperature sensor is picked")
+		if err := sensorsFlags.Parse(args[1:]); err != nil {
+			return nil, err
+		}
+		if sensorsFlags.NArg() > 0 {
+			return nil, unknownCommandErr
+		}
 	} else if len(args) == 1 {
 		switch args[0] {
 		case "install":
 			intent = cliIntentInstall
-		case "sensors:print":
-			intent = cliIntentPrintSensors
+		case "discover":
+			intent = cliIntentDiscover
 		default:
 			return nil, unknownCommandErr
 		}
@@ -62,10 +79,11 @@ func parseCliOptions() (*cliOptions, error) {
 	return &cliOptions{
 		intent:     intent,
 		configPath: *configPath,
+		explain:    explain,
 	}, nil
 }
 
-func cliSensorsPrint() int {
+func cliSensorsPrint(explain bool, configPath string) int {
 	tempSensors, err := sensors.SensorsTemperatures()
 	if err != nil {
 		if warns, ok := err.(*sensors.Warnings); ok {
@@ -80,15 +98,106 @@ func cliSensorsPrint() int {
 		}
 	}
 
-	if len(tempSensors) == 0 {
+	hwmonSensors, err := readHwmonSensors()
+	if err != nil {
+		fmt.Printf("Failed to read hwmon sensors: %v\n\n", err)
+	}
+
+	if len(tempSensors) == 0 && len(hwmonSensors) == 0 {
 		fmt.Println("No sensors found")
 		return 0
 	}
 
-	fmt.Println("Sensors found:")
-	for _, sensor := range tempSensors {
-		fmt.Printf(" %s: %.1f°C\n", sensor.SensorKey, sensor.Temperature)
+	if len(tempSensors) > 0 {
+		fmt.Println("Temperature sensors, for use with cpu-temp-sensor:")
+		for _, sensor := range tempSensors {
+			fmt.Printf(" %s: %.1f°C\n", sensor.SensorKey, sensor.Temperature)
+		}
+	}
+
+	if len(hwmonSensors) > 0 {
+		if len(tempSensors) > 0 {
+			fmt.Println()
+		}
+		fmt.Println("Hardware monitoring sensors, for use with system.sensors:")
+		for _, sensor := range hwmonSensors {
+			fmt.Printf(" %s: %s", sensor.Key, formatSensorValue(sensor.Unit, sensor.Value))
+			if sensor.MaxIsAvailable {
+				fmt.Printf(", max %s", formatSensorValue(sensor.Unit, sensor.Max))
+			}
+			if sensor.CriticalIsAvailable {
+				fmt.Printf(", critical %s", formatSensorValue(sensor.Unit, sensor.Critical))
+			}
+			fmt.Println()
+		}
+	}
+
+	if explain {
+		fmt.Println()
+		explainCPUTempSensor(tempSensors, configPath)
 	}
 
 	return 0
 }
+
+func explainCPUTempSensor(tempSensors []sensors.TemperatureStat, configPath string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Printf("Failed to load the config, ignoring it: %v\n\n", err)
+	} else if key := config.System.CPUTempSensor; key != "" {
+		if slices.ContainsFunc(tempSensors, func(s sensors.TemperatureStat) bool { return s.SensorKey == key }) {
+			fmt.Printf("The CPU temperature is read from %s since it's set as cpu-temp-sensor in the config. Without it:\n\n", key)
+		} else {
+			fmt.Printf("cpu-temp-sensor is set to %s in the config, but there's no such sensor so the CPU temperature isn't available. Without it:\n\n", key)
+		}
+	}
+
+	candidates := rankCPUTempSensors(tempSensors)
+	if len(candidates) == 0 {
+		fmt.Println("None of the sensors are known to be the CPU temperature, set cpu-temp-sensor in the config to one of those listed above")
+		return
+	}
+
+	selected := inferCPUTempSensor(tempSensors)
+	if selected == nil {
+		fmt.Println("None of the known CPU temperature sensors can be used:")
+	} else {
+		fmt.Printf("The CPU temperature would be read from %s. Known CPU temperature sensors, from most to least preferred:\n", selected.SensorKey)
+	}
+
+	for _, candidate := range candidates {
+		marker := " "
+		if candidate.sensor == selected {
+			marker = ">"
+		}
+		fmt.Printf(" %s %s: %.1f°C, %s\n", marker, candidate.sensor.SensorKey, candidate.sensor.Temperature, candidate.description)
+		if candidate.rejection != "" {
+			fmt.Printf("     Skipped since it %s\n", candidate.rejection)
+		}
+	}
+
+	var unknown []string
+	for _, sensor := range tempSensors {
+		if !slices.ContainsFunc(candidates, func(c cpuTempSensorCandidate) bool { return c.sensor.SensorKey == sensor.SensorKey }) {
+			unknown = append(unknown, sensor.SensorKey)
+		}
+	}
+	if len(unknown) > 0 {
+		fmt.Printf("\nNot known to be CPU temperature sensors: %s\n", strings.Join(unknown, ", "))
+	}
+}
+
+func formatSensorValue(unit string, value float64) string {
+	switch unit {
+	case "celsius":
+		return fmt.Sprintf("%.1f°C", value)
+	case "rpm":
+		return fmt.Sprintf("%.0f RPM", value)
+	case "volts":
+		return fmt.Sprintf("%.3f V", value)
+	case "watts":
+		return fmt.Sprintf("%.2f W", value)
+	}
+
+	return fmt.Sprintf("%g %s", value, unit)
+}
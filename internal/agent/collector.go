@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luna-page/luna/pkg/sysinfo"
+)
+
+// Sections that haven't been asked for within this long stop getting collected
+// in the background until someone asks for them again
+const sectionIdleTimeout = 1 * time.Minute
+
+type collector struct {
+	config   *systemConfig
+	request  *sysinfo.SystemInfoRequest
+	interval time.Duration
+
+	// Held while collecting a section so that it never gets collected by more than one goroutine
+	// at a time, while different sections get collected independently of each other. The state
+	// kept by sections between collections is only accessed while holding their lock.
+	sectionMu map[string]*sync.Mutex
+	hostInfo  *apiHostInfo
+	// Network and FUSE filesystems by path, whose usage gets probed in the background
+	probedMounts map[string]*probedMount
+	// By the directory of each RAPL domain, to calculate power from the change in energy
+	raplSamples map[string]raplSample
+
+	// Sources that are too slow to run on every collection
+	smart     *refresher[[]apiSMARTDeviceInfo]
+	zfsPools  *refresher[[]apiZFSPoolInfo]
+	zfsUsages *refresher[map[string]zfsPoolUsage]
+	ups       *refresher[[]apiUPSInfo]
+
+	mu            sync.RWMutex
+	latest        apiSystemInfo
+	collectedAt   map[string]time.Time
+	lastRequested map[string]time.Time
+	// Notified after each background collection
+	subscribers []chan struct{}
+	// When each section that's currently being collected started getting collected
+	collectingSince map[string]time.Time
+
+	// Unix nanoseconds of the last tick of run or completed collection, used
+	// along with collectingSince to decide whether the watchdog should be kept alive
+	lastProgress atomic.Int64
+}
+
+func newCollector(config *systemConfig) *collector {
+	c := &collector{
+		config:        config,
+		request:       &config.SystemInfoRequest,
+		interval:      config.Interval,
+		sectionMu:     make(map[string]*sync.Mutex, len(sections)),
+		collectedAt:   make(map[string]time.Time),
+		lastRequested: make(map[string]time.Time),
+
+		collectingSince: make(map[string]time.Time),
+	}
+
+	for _, name := range sectionNames() {
+		c.sectionMu[name] = &sync.Mutex{}
+	}
+
+	c.smart = newRefresher(config.SMART.interval(), c.refreshSMART)
+	c.zfsPools = newRefresher(config.ZFS.interval(), refreshZFSPools)
+	c.zfsUsages = newRefresher(config.ZFS.interval(), refreshZFSPoolUsages)
+	c.ups = newRefresher(config.NUT.interval(), c.refreshUPS)
+
+	return c
+}
+
+func (c *collector) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Also counts when no sections are active, since an idle agent is still a healthy one
+			c.lastProgress.Store(time.Now().UnixNano())
+
+			// Sections that are still being collected since an earlier tick get skipped
+			var wg sync.WaitGroup
+			for _, name := range c.activeSections() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.collectSection(findSection(name), false)
+				}()
+			}
+
+			go func() {
+				wg.Wait()
+				c.notifySubscribers()
+			}()
+		}
+	}
+}
+
+// Returns a channel that receives a value after each background collection. Collections
+// that happen while the subscriber is still busy with an earlier one only get notified once.
+func (c *collector) subscribe() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	c.mu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.mu.Unlock()
+
+	return ch
+}
+
+func (c *collector) notifySubscribers() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *collector) activeSections() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var active []string
+	for _, name := range sectionNames() {
+		if time.Since(c.lastRequested[name]) < sectionIdleTimeout {
+			active = append(active, name)
+		}
+	}
+
+	return active
+}
+
+// Must be called with mu held. Allows for two intervals to give the background collection some leeway.
+func (c *collector) isStale(name string) bool {
+	return time.Since(c.collectedAt[name]) > 2*c.interval
+}
+
+// When called for a request, waits for any ongoing collection of the section and skips
+// collecting it again if that made it fresh. Otherwise returns right away if it's ongoing.
+func (c *collector) collectSection(s *section, forRequest bool) {
+	mu := c.sectionMu[s.name]
+	if forRequest {
+		mu.Lock()
+	} else if !mu.TryLock() {
+		return
+	}
+	defer mu.Unlock()
+
+	if forRequest {
+		c.mu.RLock()
+		stale := c.isStale(s.name)
+		c.mu.RUnlock()
+		if !stale {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	c.collectingSince[s.name] = time.Now()
+	c.mu.Unlock()
+
+	var collected apiSystemInfo
+	errs := s.collect(c, &collected)
+
+	// Behind logDebug since this runs every interval and if there
+	// are a lot of errors, it could get very spammy
+	if logDebug {
+		for _, err := range errs {
+			slog.Debug("Error while collecting system info", "section", s.name, "error", err)
+		}
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	s.copy(&c.latest, &collected)
+	c.collectedAt[s.name] = now
+	delete(c.collectingSince, s.name)
+	c.mu.Unlock()
+
+	c.lastProgress.Store(now.UnixNano())
+}
+
+// Returns system info containing only the given sections along with the time at which the
+// most recent of them was collected. Sections that aren't being collected in the background
+// because nobody asked for them recently get collected before returning, concurrently and
+// without waiting for any other sections.
+func (c *collector) get(names []string) (*apiSystemInfo, time.Time) {
+	now := time.Now()
+	var stale []string
+
+	c.mu.Lock()
+	for _, name := range names {
+		c.lastRequested[name] = now
+		if c.isStale(name) {
+			stale = append(stale, name)
+		}
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, name := range stale {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.collectSection(findSection(name), true)
+		}()
+	}
+	wg.Wait()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	info := &apiSystemInfo{}
+	var collectedAt time.Time
+
+	for _, name := range names {
+		findSection(name).copy(info, &c.latest)
+		if t := c.collectedAt[name]; t.After(collectedAt) {
+			collectedAt = t
+		}
+	}
+
+	return info, collectedAt
+}
+
+// isProgressing reports whether the collector ticked or completed a collection recently
+// enough and no section has been getting collected for too long, such as because of a
+// hung mount, allowing for one full interval plus the given grace period
+func (c *collector) isProgressing(grace time.Duration) bool {
+	limit := c.interval + grace
+
+	if time.Since(time.Unix(0, c.lastProgress.Load())) >= limit {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, since := range c.collectingSince {
+		if time.Since(since) >= limit {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSection(c *collector, name string, collect func(*collector, *apiSystemInfo) []error) *section {
+	c.sectionMu[name] = &sync.Mutex{}
+	return &section{
+		name:    name,
+		collect: collect,
+		copy:    func(dst, src *apiSystemInfo) {},
+	}
+}
+
+func TestCollectSectionOnceForConcurrentRequests(t *testing.T) {
+	c := newCollector(&systemConfig{Interval: time.Minute})
+
+	var collections atomic.Int32
+	s := newTestSection(c, "slow", func(*collector, *apiSystemInfo) []error {
+		collections.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.collectSection(s, true)
+		}()
+	}
+	wg.Wait()
+
+	if n := collections.Load(); n != 1 {
+		t.Errorf("expected the section to be collected once, got %d", n)
+	}
+}
+
+func TestCollectSectionDoesNotWaitForOthers(t *testing.T) {
+	c := newCollector(&systemConfig{Interval: time.Minute})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	slow := newTestSection(c, "slow", func(*collector, *apiSystemInfo) []error {
+		close(started)
+		<-release
+		return nil
+	})
+	fast := newTestSection(c, "fast", func(*collector, *apiSystemInfo) []error {
+		return nil
+	})
+
+	go c.collectSection(slow, false)
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		c.collectSection(fast, true)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("collecting a section waited for another one")
+	}
+
+	// A background collection gets skipped while the section is still being collected
+	skipped := make(chan struct{})
+	go func() {
+		c.collectSection(slow, false)
+		close(skipped)
+	}()
+
+	select {
+	case <-skipped:
+	case <-time.After(time.Second):
+		t.Fatal("background collection waited for an ongoing one")
+	}
+}
+
+func TestIdleCollectorIsProgressing(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	const grace = 50 * time.Millisecond
+
+	c := newCollector(&systemConfig{Interval: interval})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+
+	// Nothing gets requested, so no sections are collected in the background
+	time.Sleep(4 * (interval + grace))
+
+	if !c.isProgressing(grace) {
+		t.Error("expected an idle collector to be progressing")
+	}
+}
+
+func TestStuckCollectionIsNotProgressing(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	const grace = 50 * time.Millisecond
+
+	c := newCollector(&systemConfig{Interval: interval})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	stuck := newTestSection(c, "stuck", func(*collector, *apiSystemInfo) []error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+
+	go c.collectSection(stuck, false)
+	<-started
+	time.Sleep(2 * (interval + grace))
+
+	if c.isProgressing(grace) {
+		t.Error("expected a collector with a stuck section not to be progressing")
+	}
+}
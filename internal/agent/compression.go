@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Responses smaller than this aren't worth the overhead of compressing
+const minCompressionSize = 512
+
+type compressionEncoding struct {
+	name      string
+	newWriter func(w io.Writer) io.WriteCloser
+}
+
+var zstdEncoderPool = sync.Pool{
+	New: func() any {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return encoder
+	},
+}
+
+// In order of preference when the client accepts multiple with the same q-value
+var compressionEncodings = []compressionEncoding{
+	{"zstd", func(w io.Writer) io.WriteCloser {
+		encoder := zstdEncoderPool.Get().(*zstd.Encoder)
+		encoder.Reset(w)
+		return &pooledZstdEncoder{encoder}
+	}},
+	{"gzip", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}},
+}
+
+type pooledZstdEncoder struct {
+	*zstd.Encoder
+}
+
+func (e *pooledZstdEncoder) Close() error {
+	err := e.Encoder.Close()
+	zstdEncoderPool.Put(e.Encoder)
+	return err
+}
+
+// Compresses successful responses using the best encoding that the client accepts.
+// Responses get buffered in full before being written, which is fine given their size.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == nil || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		if buffered.status != http.StatusOK || buffered.body.Len() < minCompressionSize || w.Header().Get("Content-Encoding") != "" {
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+			return
+		}
+
+		var compressed bytes.Buffer
+		encoder := encoding.newWriter(&compressed)
+		_, err := encoder.Write(buffered.body.Bytes())
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			w.WriteHeader(buffered.status)
+			w.Write(buffered.body.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", encoding.name)
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.WriteHeader(buffered.status)
+		w.Write(compressed.Bytes())
+	})
+}
+
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// Picks the encoding with the highest q-value from an Accept-Encoding header,
+// returns nil if none of the supported encodings are acceptable
+func negotiateEncoding(header string) *compressionEncoding {
+	if header == "" {
+		return nil
+	}
+
+	qualities := map[string]float64{}
+	for part := range strings.SplitSeq(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = q
+			}
+		}
+
+		qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+	}
+
+	var best *compressionEncoding
+	bestQuality := 0.0
+
+	for i := range compressionEncodings {
+		quality, ok := qualities[compressionEncodings[i].name]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+
+		if ok && quality > bestQuality {
+			best = &compressionEncodings[i]
+			bestQuality = quality
+		}
+	}
+
+	return best
+}
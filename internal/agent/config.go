@@ -1,46 +1,249 @@
 package agent
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/luna-page/luna/pkg/sysinfo"
 	"gopkg.in/yaml.v3"
 )
 
 const defaultPort = 27973
+const defaultShutdownTimeout = 10 * time.Second
+const defaultCollectInterval = 1 * time.Second
 
 type config struct {
 	Server struct {
-		Host  string `yaml:"host"`
-		Port  int    `yaml:"port"`
-		Token string `yaml:"token"`
+		// The top level host, port, token etc. make up the listener
+		// that gets used when no listeners are explicitly defined
+		listenerConfig  `yaml:",inline"`
+		Listeners       []listenerConfig `yaml:"listeners"`
+		ShutdownTimeout time.Duration    `yaml:"shutdown-timeout"`
 	} `yaml:"server"`
 
-	SystemInfoRequest *sysinfo.SystemInfoRequest `yaml:"system"`
+	System systemConfig `yaml:"system"`
+	Push   pushConfig   `yaml:"push"`
+	Tunnel tunnelConfig `yaml:"tunnel"`
+	MDNS   mdnsConfig   `yaml:"mdns"`
+	MQTT   mqttConfig   `yaml:"mqtt"`
+
+	Outputs []outputConfig `yaml:"outputs"`
+
+	Aggregate aggregateConfig `yaml:"aggregate"`
+
+	// Path of the config file, which may not exist when configuring through
+	// environment variables. Other files managed by the agent are kept next to it.
+	path string
+}
+
+type listenerConfig struct {
+	// Used to match sockets passed through systemd socket activation, see FileDescriptorName=
+	Name  string `yaml:"name"`
+	Host  string `yaml:"host"`
+	Port  int    `yaml:"port"`
+	Token string `yaml:"token"`
+
+	UnixSocket      string `yaml:"unix-socket"`
+	UnixSocketMode  string `yaml:"unix-socket-mode"`
+	UnixSocketOwner string `yaml:"unix-socket-owner"`
+
+	TLS struct {
+		CertFile string `yaml:"cert-file"`
+		KeyFile  string `yaml:"key-file"`
+	} `yaml:"tls"`
+
+	CORS corsConfig `yaml:"cors"`
+
+	// Which groups of endpoints are served, all of them when empty
+	Endpoints []string `yaml:"endpoints"`
+}
+
+type systemConfig struct {
+	sysinfo.SystemInfoRequest `yaml:",inline"`
+	Interval                  time.Duration           `yaml:"interval"`
+	ZFS                       zfsConfig               `yaml:"zfs"`
+	SMART                     smartConfig             `yaml:"smart"`
+	NetworkMounts             networkMountsConfig     `yaml:"network-mounts"`
+	Sensors                   map[string]sensorConfig `yaml:"sensors"`
+	NUT                       nutConfig               `yaml:"nut"`
+
+	// Keys of mountpoints in the order they were defined in and the rules compiled from them
+	mountpointOrder []string
+	mountpointRules []mountpointRule
+	// The timeout option of mountpoints, which isn't part of sysinfo.MointpointRequest
+	mountpointTimeouts map[string]time.Duration
 }
 
 func loadConfig(path string) (*config, error) {
 	contents, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
-		return loadConfigFromEnvs(), nil
+		config := loadConfigFromEnvs()
+		config.path = path
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		return config, nil
 	} else if err != nil {
 		return nil, err
 	}
 
 	config := &config{}
-	config.Server.Port = defaultPort
+	config.Server.ShutdownTimeout = defaultShutdownTimeout
+	config.System.Interval = defaultCollectInterval
+	config.MQTT.HomeAssistant.Discovery = true
 
 	err = yaml.Unmarshal(contents, &config)
 	if err != nil {
 		return nil, err
 	}
 
+	// Defaulted after unmarshalling so that validate can tell whether the top level port was set
+	if len(config.Server.Listeners) == 0 && config.Server.Port == 0 && config.Server.UnixSocket == "" {
+		config.Server.Port = defaultPort
+	}
+
+	for i := range config.Server.Listeners {
+		l := &config.Server.Listeners[i]
+		if l.Port == 0 && l.UnixSocket == "" {
+			l.Port = defaultPort
+		}
+	}
+
+	config.path = path
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
+func (c *config) validate() error {
+	if c.System.Interval <= 0 {
+		return fmt.Errorf("system.interval must be positive, got %v", c.System.Interval)
+	}
+
+	// They would otherwise get ignored without notice, which for a token
+	// means that the listeners end up without authentication
+	if len(c.Server.Listeners) > 0 {
+		if fields := c.Server.listenerConfig.setFields(); len(fields) > 0 {
+			return fmt.Errorf("server.%s can't be used along with server.listeners, move it into each of the listeners instead", strings.Join(fields, ", server."))
+		}
+	}
+
+	for _, l := range c.listeners() {
+		if (l.TLS.CertFile == "") != (l.TLS.KeyFile == "") {
+			return fmt.Errorf("listener %s: tls requires both cert-file and key-file", l.displayName())
+		}
+
+		if err := l.CORS.validate(); err != nil {
+			return fmt.Errorf("listener %s: %v", l.displayName(), err)
+		}
+
+		for _, e := range l.Endpoints {
+			if !slices.Contains(endpointGroups, e) {
+				return fmt.Errorf("listener %s: unknown endpoint group %q, expected one of: %s", l.displayName(), e, strings.Join(endpointGroups, ", "))
+			}
+		}
+	}
+
+	if err := c.System.compileMountpointRules(); err != nil {
+		return err
+	}
+
+	if err := c.System.ZFS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.System.SMART.validate(); err != nil {
+		return err
+	}
+
+	if err := c.System.NetworkMounts.validate(); err != nil {
+		return err
+	}
+
+	if err := c.System.NUT.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Push.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tunnel.validate(); err != nil {
+		return err
+	}
+
+	if err := c.MQTT.validate(); err != nil {
+		return err
+	}
+
+	if err := c.MDNS.validate(); err != nil {
+		return err
+	}
+
+	for i := range c.Outputs {
+		if err := c.Outputs[i].validate(); err != nil {
+			return fmt.Errorf("outputs[%d]: %v", i, err)
+		}
+	}
+
+	return c.Aggregate.validate()
+}
+
+func (c *config) listeners() []listenerConfig {
+	if len(c.Server.Listeners) > 0 {
+		return c.Server.Listeners
+	}
+
+	return []listenerConfig{c.Server.listenerConfig}
+}
+
+// Returns the names of the fields that are set, for the top level listener
+func (l *listenerConfig) setFields() []string {
+	var fields []string
+	add := func(name string, set bool) {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+
+	add("name", l.Name != "")
+	add("host", l.Host != "")
+	add("port", l.Port != 0)
+	add("token", l.Token != "")
+	add("unix-socket", l.UnixSocket != "")
+	add("unix-socket-mode", l.UnixSocketMode != "")
+	add("unix-socket-owner", l.UnixSocketOwner != "")
+	add("tls", l.TLS.CertFile != "" || l.TLS.KeyFile != "")
+	add("cors", len(l.CORS.AllowedOrigins) > 0 || len(l.CORS.AllowedHeaders) > 0 || l.CORS.AllowCredentials || l.CORS.MaxAge != 0)
+	add("endpoints", len(l.Endpoints) > 0)
+
+	return fields
+}
+
+func (l *listenerConfig) displayName() string {
+	if l.Name != "" {
+		return l.Name
+	}
+
+	if l.UnixSocket != "" {
+		return l.UnixSocket
+	}
+
+	return fmt.Sprintf("%s:%d", l.Host, l.Port)
+}
+
+func (l *listenerConfig) servesEndpointGroup(group string) bool {
+	return len(l.Endpoints) == 0 || slices.Contains(l.Endpoints, group)
+}
+
 func loadConfigFromEnvs() *config {
 	c := &config{}
 
@@ -56,27 +259,72 @@ func loadConfigFromEnvs() *config {
 
 	c.Server.Port = port
 	c.Server.Token = os.Getenv("TOKEN")
+	c.Server.ShutdownTimeout = defaultShutdownTimeout
+	c.Server.UnixSocket = os.Getenv("UNIX_SOCKET")
+	c.Server.UnixSocketMode = os.Getenv("UNIX_SOCKET_MODE")
+	c.Server.UnixSocketOwner = os.Getenv("UNIX_SOCKET_OWNER")
+
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		for origin := range strings.SplitSeq(origins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.Server.CORS.AllowedOrigins = append(c.Server.CORS.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	c.Push.URL = os.Getenv("PUSH_URL")
+	c.Push.Secret = os.Getenv("PUSH_SECRET")
+	if pushInterval := os.Getenv("PUSH_INTERVAL"); pushInterval != "" {
+		var err error
+		c.Push.Interval, err = time.ParseDuration(pushInterval)
+		if err != nil {
+			log.Panicf("Push interval must be a valid duration, got: %v", err)
+		}
+	}
+
+	c.MQTT.Broker = os.Getenv("MQTT_BROKER")
+	c.MQTT.Username = os.Getenv("MQTT_USERNAME")
+	c.MQTT.Password = os.Getenv("MQTT_PASSWORD")
+	c.MQTT.TopicPrefix = os.Getenv("MQTT_TOPIC_PREFIX")
+	c.MQTT.HomeAssistant.Discovery = os.Getenv("MQTT_HOME_ASSISTANT_DISCOVERY") != "false"
+
+	c.MDNS.Enabled = os.Getenv("MDNS_ENABLED") == "true"
+	c.MDNS.Name = os.Getenv("MDNS_NAME")
+
+	c.Tunnel.URL = os.Getenv("TUNNEL_URL")
+	c.Tunnel.Token = os.Getenv("TUNNEL_TOKEN")
+	c.Tunnel.HubPublicKeySHA256 = os.Getenv("TUNNEL_HUB_PUBLIC_KEY_SHA256")
 
 	hideMountpoints := os.Getenv("HIDE_MOUNTPOINTS_BY_DEFAULT") == "true"
+	c.System.ZFS.CollapseDatasets = os.Getenv("ZFS_COLLAPSE_DATASETS") == "true"
+	c.System.SMART.Enabled = os.Getenv("SMART_ENABLED") == "true"
+	if devices := os.Getenv("SMART_DEVICES"); devices != "" {
+		for device := range strings.SplitSeq(devices, ",") {
+			if device = strings.TrimSpace(device); device != "" {
+				c.System.SMART.Devices = append(c.System.SMART.Devices, smartDeviceConfig{Path: device})
+			}
+		}
+	}
 
-	c.SystemInfoRequest = &sysinfo.SystemInfoRequest{
+	c.System.NUT.Address = os.Getenv("NUT_ADDRESS")
+	c.System.NUT.Username = os.Getenv("NUT_USERNAME")
+	c.System.NUT.Password = os.Getenv("NUT_PASSWORD")
+
+	if timeout := os.Getenv("NETWORK_MOUNT_TIMEOUT"); timeout != "" {
+		var err error
+		c.System.NetworkMounts.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Panicf("Network mount timeout must be a valid duration, got: %v", err)
+		}
+	}
+
+	c.System.Interval = defaultCollectInterval
+	c.System.SystemInfoRequest = sysinfo.SystemInfoRequest{
 		CPUTempSensor:            os.Getenv("TEMP_SENSOR"),
 		HideMountpointsByDefault: hideMountpoints,
 		Mountpoints:              make(map[string]sysinfo.MointpointRequest),
 	}
-	mr := c.SystemInfoRequest.Mountpoints
-
-	if !hideMountpoints && isRunningInsideDockerContainer() {
-		// Hide some common container mountpoints by default
-		for _, mp := range []string{
-			"/etc/hosts",
-			"/etc/resolv.conf",
-			"/etc/hostname",
-		} {
-			t := true
-			mr[mp] = sysinfo.MointpointRequest{Hide: &t}
-		}
-	}
+	mr := c.System.Mountpoints
 
 	mountpoints := os.Getenv("MOUNTPOINTS")
 	if mountpoints != "" {
@@ -85,16 +333,18 @@ func loadConfigFromEnvs() *config {
 			if mp == "" {
 				continue
 			}
+			mp, hide := strings.CutPrefix(mp, "!")
+			// Rules for types and regexes, such as !type:tmpfs, don't have a name
+			if strings.HasPrefix(mp, mountpointTypeRulePrefix) || strings.HasPrefix(mp, mountpointRegexRulePrefix) {
+				mr[mp] = sysinfo.MointpointRequest{Hide: &hide}
+				c.System.mountpointOrder = append(c.System.mountpointOrder, mp)
+				continue
+			}
 			path, name, _ := strings.Cut(mp, ":")
-			path, hide := strings.CutPrefix(path, "!")
 			mr[path] = sysinfo.MointpointRequest{Name: name, Hide: &hide}
+			c.System.mountpointOrder = append(c.System.mountpointOrder, path)
 		}
 	}
 
 	return c
 }
-
-func isRunningInsideDockerContainer() bool {
-	_, err := os.Stat("/.dockerenv")
-	return err == nil
-}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, contents string) (*config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "agent.yml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadConfig(path)
+}
+
+func TestTopLevelListenerFieldsWithListeners(t *testing.T) {
+	_, err := loadTestConfig(t, `
+server:
+  token: secret
+  listeners:
+    - port: 9100
+`)
+	if err == nil || !strings.Contains(err.Error(), "server.token") {
+		t.Errorf("expected an error about server.token, got %v", err)
+	}
+
+	_, err = loadTestConfig(t, `
+server:
+  port: 27973
+  host: 127.0.0.1
+  listeners:
+    - port: 9100
+`)
+	if err == nil || !strings.Contains(err.Error(), "server.host, server.port") {
+		t.Errorf("expected an error about server.host and server.port, got %v", err)
+	}
+
+	// Empty lists, such as those copied from the example config, don't count as being set
+	config, err := loadTestConfig(t, `
+server:
+  shutdown-timeout: 5s
+  endpoints: []
+  cors:
+    allowed-origins: []
+  listeners:
+    - port: 9100
+      token: secret
+    - unix-socket: /run/luna-agent.sock
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners := config.listeners(); len(listeners) != 2 || listeners[0].Token != "secret" || listeners[1].Port != 0 {
+		t.Errorf("unexpected listeners %+v", listeners)
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	config, err := loadTestConfig(t, "server:\n  token: secret\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners := config.listeners(); len(listeners) != 1 || listeners[0].Port != defaultPort {
+		t.Errorf("expected a single listener on the default port, got %+v", listeners)
+	}
+}
+
+func TestMDNSNameLength(t *testing.T) {
+	if _, err := loadTestConfig(t, "mdns:\n  name: "+strings.Repeat("a", 63)+"\n"); err != nil {
+		t.Errorf("expected a 63 byte name to be accepted, got %v", err)
+	}
+
+	_, err := loadTestConfig(t, "mdns:\n  name: "+strings.Repeat("a", 64)+"\n")
+	if err == nil || !strings.Contains(err.Error(), "mdns.name") {
+		t.Errorf("expected an error about mdns.name, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCORSMaxAge = 10 * time.Minute
+
+type corsConfig struct {
+	// Either exact origins such as https://example.com or * to allow any origin
+	AllowedOrigins   []string      `yaml:"allowed-origins"`
+	AllowedHeaders   []string      `yaml:"allowed-headers"`
+	AllowCredentials bool          `yaml:"allow-credentials"`
+	MaxAge           time.Duration `yaml:"max-age"`
+}
+
+func (c *corsConfig) validate() error {
+	// Browsers refuse a literal * alongside credentials, and reflecting the origin instead
+	// would let any page make requests with the credentials of whoever is visiting it
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		return errors.New("cors.allow-credentials can't be used when cors.allowed-origins contains *, list the allowed origins instead")
+	}
+
+	return nil
+}
+
+// Answers preflight requests and adds the CORS headers to responses for allowed
+// origins. Must wrap the token check since browsers never send the Authorization
+// header with preflight requests.
+func withCORS(config *corsConfig, next http.Handler) http.Handler {
+	if len(config.AllowedOrigins) == 0 {
+		return next
+	}
+
+	allowAnyOrigin := slices.Contains(config.AllowedOrigins, "*")
+
+	allowedHeaders := config.AllowedHeaders
+	if len(allowedHeaders) == 0 {
+		allowedHeaders = []string{"Authorization"}
+	}
+	allowedHeadersValue := strings.Join(allowedHeaders, ", ")
+
+	maxAge := config.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	maxAgeValue := strconv.Itoa(int(maxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		header := w.Header()
+		header.Add("Vary", "Origin")
+
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !allowAnyOrigin && !slices.Contains(config.AllowedOrigins, origin) {
+			if isPreflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowAnyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if config.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !isPreflight {
+			header.Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", allowedHeadersValue)
+		header.Set("Access-Control-Max-Age", maxAgeValue)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
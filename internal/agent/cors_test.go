@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSConfigValidate(t *testing.T) {
+	tests := []struct {
+		config  corsConfig
+		wantErr bool
+	}{
+		{corsConfig{AllowedOrigins: []string{"*"}}, false},
+		{corsConfig{AllowedOrigins: []string{"https://a.example"}, AllowCredentials: true}, false},
+		{corsConfig{AllowedOrigins: []string{"https://a.example", "*"}, AllowCredentials: true}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.config.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate() of %+v returned %v", test.config, err)
+		}
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name        string
+		config      corsConfig
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		credentials bool
+	}{
+		{"any origin", corsConfig{AllowedOrigins: []string{"*"}}, "https://a.example", false, http.StatusOK, "*", false},
+		{"listed origin with credentials", corsConfig{AllowedOrigins: []string{"https://a.example"}, AllowCredentials: true}, "https://a.example", false, http.StatusOK, "https://a.example", true},
+		{"unlisted origin", corsConfig{AllowedOrigins: []string{"https://a.example"}}, "https://b.example", false, http.StatusOK, "", false},
+		{"preflight from an unlisted origin", corsConfig{AllowedOrigins: []string{"https://a.example"}}, "https://b.example", true, http.StatusForbidden, "", false},
+		{"preflight", corsConfig{AllowedOrigins: []string{"https://a.example"}}, "https://a.example", true, http.StatusNoContent, "https://a.example", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := http.MethodGet
+			if test.preflight {
+				method = http.MethodOptions
+			}
+
+			r := httptest.NewRequest(method, "/api/v1/sysinfo/all", nil)
+			r.Header.Set("Origin", test.origin)
+			if test.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+
+			w := httptest.NewRecorder()
+			withCORS(&test.config, next).ServeHTTP(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, test.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != test.credentials {
+				t.Errorf("got Access-Control-Allow-Credentials %v, want %v", got, test.credentials)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/shirou/gopsutil/v4/sensors"
+)
+
+// Readings outside of this range come from sensors that aren't connected or misreport
+const (
+	minPlausibleCPUTemp = 1
+	maxPlausibleCPUTemp = 150
+)
+
+// Known CPU temperature sensors from most to least preferred, matched against the
+// keys of sensors with path.Match. Used when cpu-temp-sensor isn't set in the config.
+var cpuTempSensorRules = []struct {
+	pattern     string
+	description string
+}{
+	{"coretemp_package_id_0", "Intel package temperature, the hottest of all cores"},
+	{"coretemp_package_id_*", "Intel package temperature of another socket"},
+	{"k10temp_tdie", "AMD die temperature, which unlike Tctl doesn't include the offset some models add"},
+	{"k10temp_tctl", "AMD control temperature, which some Ryzen and Threadripper models report offset above the actual temperature"},
+	{"zenpower_tdie", "AMD die temperature from the zenpower driver"},
+	{"zenpower_tctl", "AMD control temperature from the zenpower driver"},
+	{"k10temp", "AMD temperature from kernels that don't label it"},
+	{"zenpower", "AMD temperature from the zenpower driver without a label"},
+	{"cpu_thermal", "CPU thermal zone of ARM boards such as the Raspberry Pi"},
+	{"cpu-thermal", "CPU thermal zone of ARM boards such as the Raspberry Pi"},
+	{"soc_thermal", "SoC thermal zone of ARM boards such as Rockchip ones, which covers the CPU"},
+	{"soc-thermal", "SoC thermal zone of ARM boards such as Rockchip ones, which covers the CPU"},
+	{"x86_pkg_temp", "Intel package thermal zone, reported when the coretemp driver isn't loaded"},
+	{"k10temp_tccd*", "Temperature of a single AMD chiplet, lower than that of the whole package under load"},
+	{"coretemp_core_*", "Temperature of a single Intel core"},
+	{"coretemp", "Intel temperature from kernels that don't label it"},
+	{"cpu*_thermal", "Thermal zone of a single CPU cluster of ARM boards"},
+	{"cpu*-thermal", "Thermal zone of a single CPU cluster of ARM boards"},
+}
+
+// A sensor matching one of cpuTempSensorRules
+type cpuTempSensorCandidate struct {
+	sensor      *sensors.TemperatureStat
+	rank        int
+	description string
+	// Why the sensor can't be used despite matching, empty if it can
+	rejection string
+}
+
+// Returns the sensors that could be the CPU temperature from most to least preferred,
+// with those matching the same rule kept in the order they were read in
+func rankCPUTempSensors(readings []sensors.TemperatureStat) []cpuTempSensorCandidate {
+	var candidates []cpuTempSensorCandidate
+
+	for i := range readings {
+		for rank, rule := range cpuTempSensorRules {
+			if matched, _ := path.Match(rule.pattern, readings[i].SensorKey); !matched {
+				continue
+			}
+
+			candidate := cpuTempSensorCandidate{sensor: &readings[i], rank: rank, description: rule.description}
+			if t := readings[i].Temperature; t < minPlausibleCPUTemp || t > maxPlausibleCPUTemp {
+				candidate.rejection = fmt.Sprintf("reads %.1f°C, which isn't plausible", t)
+			}
+			candidates = append(candidates, candidate)
+			break
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b cpuTempSensorCandidate) int {
+		return a.rank - b.rank
+	})
+
+	return candidates
+}
+
+func inferCPUTempSensor(readings []sensors.TemperatureStat) *sensors.TemperatureStat {
+	for _, candidate := range rankCPUTempSensors(readings) {
+		if candidate.rejection == "" {
+			return candidate.sensor
+		}
+	}
+
+	return nil
+}
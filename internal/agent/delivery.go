@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// Periodically takes a sample and delivers it in batches along with those that couldn't be
+// delivered before, backing off exponentially while deliveries keep failing. Used by push
+// mode and by metrics outputs, which only differ in what a sample is and how it gets sent.
+type bufferedDelivery[T any] struct {
+	interval   time.Duration
+	bufferSize int
+	batchSize  int
+	maxBackoff time.Duration
+	// Logged when a delivery fails, and when one succeeds after failing
+	failureMessage  string
+	recoveryMessage string
+	logger          *slog.Logger
+
+	sample  func() T
+	deliver func(ctx context.Context, batch []T) error
+
+	// Samples that haven't been delivered yet, oldest first
+	buffer []T
+}
+
+func (d *bufferedDelivery[T]) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	var nextAttempt time.Time
+
+	for {
+		d.add(d.sample())
+
+		if !time.Now().Before(nextAttempt) {
+			if err := d.flush(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				backoff = min(max(2*backoff, d.interval), d.maxBackoff)
+				// Jitter so that agents which lost the connection at the same
+				// time don't all come back at once when it gets restored
+				if jitter := backoff / 4; jitter > 0 {
+					backoff += rand.N(jitter)
+				}
+				nextAttempt = time.Now().Add(backoff)
+
+				d.logger.Warn(d.failureMessage, "error", err, "buffered", len(d.buffer), "retry_in", backoff.Round(time.Second))
+			} else {
+				if backoff > 0 {
+					d.logger.Info(d.recoveryMessage)
+				}
+				backoff = 0
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drops the oldest sample when the buffer is full
+func (d *bufferedDelivery[T]) add(sample T) {
+	if len(d.buffer) >= d.bufferSize {
+		d.buffer = d.buffer[len(d.buffer)-d.bufferSize+1:]
+	}
+
+	d.buffer = append(d.buffer, sample)
+}
+
+// Delivers the buffered samples in batches, oldest first, stopping at the first failure
+func (d *bufferedDelivery[T]) flush(ctx context.Context) error {
+	for len(d.buffer) > 0 {
+		batch := d.buffer[:min(len(d.buffer), d.batchSize)]
+
+		if err := d.deliver(ctx, batch); err != nil {
+			return err
+		}
+
+		d.buffer = d.buffer[len(batch):]
+	}
+
+	// Let go of the backing array which may have grown large while deliveries were failing
+	d.buffer = nil
+	return nil
+}
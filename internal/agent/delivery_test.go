@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBufferedDeliveryDropsOldestSamplesWhenFull(t *testing.T) {
+	d := &bufferedDelivery[int]{bufferSize: 3}
+
+	for i := range 5 {
+		d.add(i)
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(d.buffer, want) {
+		t.Errorf("got buffer %v, want %v", d.buffer, want)
+	}
+}
+
+func TestBufferedDeliveryFlushesInBatches(t *testing.T) {
+	var batches [][]int
+	failAt := -1
+
+	d := &bufferedDelivery[int]{
+		bufferSize: 10,
+		batchSize:  2,
+		deliver: func(ctx context.Context, batch []int) error {
+			if len(batches) == failAt {
+				return errors.New("unavailable")
+			}
+			batches = append(batches, append([]int(nil), batch...))
+			return nil
+		},
+	}
+
+	for i := range 5 {
+		d.add(i)
+	}
+
+	// Samples from the failed batch onwards are kept for the next attempt
+	failAt = 1
+	if err := d.flush(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(d.buffer, want) {
+		t.Errorf("got buffer %v after a failed batch, want %v", d.buffer, want)
+	}
+
+	failAt = -1
+	if err := d.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{0, 1}, {2, 3}, {4}}; !reflect.DeepEqual(batches, want) {
+		t.Errorf("got batches %v, want %v", batches, want)
+	}
+	if len(d.buffer) != 0 {
+		t.Errorf("expected the buffer to be empty, got %v", d.buffer)
+	}
+}
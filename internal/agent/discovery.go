@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luna-page/agent/internal/mdns"
+)
+
+const mdnsServiceType = "_luna-agent._tcp"
+const discoverTimeout = 3 * time.Second
+
+type mdnsConfig struct {
+	// Advertise the agent on the local network so that it can be found with the discover command
+	Enabled bool `yaml:"enabled"`
+	// Shown as the name of the discovered agent, defaults to the hostname
+	Name string `yaml:"name"`
+}
+
+// The longest label a DNS name can have, which the name ends up being
+const maxMDNSNameLength = 63
+
+func (c *mdnsConfig) validate() error {
+	if len(c.Name) > maxMDNSNameLength {
+		return fmt.Errorf("mdns.name can be at most %d bytes long, got %d", maxMDNSNameLength, len(c.Name))
+	}
+
+	return nil
+}
+
+// Advertises the first listener that serves system info over TCP, which is what luna would connect to
+func advertiseAgent(ctx context.Context, config *mdnsConfig, listenerConfigs []listenerConfig, listeners [][]net.Listener) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Error("Not advertising over mDNS, could not get hostname", "error", err)
+		return
+	}
+
+	// Names under .local are single labels, nas.example.com would otherwise become nas.example.com.local
+	shortHostname, _, _ := strings.Cut(hostname, ".")
+
+	for i := range listenerConfigs {
+		listenerConfig := &listenerConfigs[i]
+		if !listenerConfig.servesEndpointGroup(endpointGroupSysinfo) {
+			continue
+		}
+
+		for _, listener := range listeners[i] {
+			addr, ok := listener.Addr().(*net.TCPAddr)
+			if !ok || addr.IP.IsLoopback() {
+				continue
+			}
+
+			// Only IPv4 addresses get advertised
+			if !addr.IP.IsUnspecified() && addr.IP.To4() == nil {
+				continue
+			}
+
+			service := &mdns.Service{
+				Instance: config.Name,
+				Type:     mdnsServiceType,
+				Host:     shortHostname,
+				Port:     uint16(addr.Port),
+				TXT: []string{
+					"hostname=" + hostname,
+					"port=" + strconv.Itoa(addr.Port),
+					"version=" + buildVersion,
+					"api=" + apiVersion,
+				},
+			}
+
+			if service.Instance == "" {
+				service.Instance = shortHostname
+			}
+
+			// Advertising the addresses of other interfaces would lead to the
+			// agent being looked for where it isn't listening
+			if !addr.IP.IsUnspecified() {
+				service.IPs = []net.IP{addr.IP}
+			}
+
+			if listenerConfig.Token != "" {
+				service.TXT = append(service.TXT, "auth=token")
+			}
+
+			if listenerConfig.TLS.CertFile != "" {
+				fingerprint, err := publicKeySHA256(listenerConfig.TLS.CertFile, listenerConfig.TLS.KeyFile)
+				if err != nil {
+					slog.Error("Not advertising over mDNS, could not get TLS fingerprint", "error", err)
+					return
+				}
+				service.TXT = append(service.TXT, "tls-sha256="+fingerprint)
+			}
+
+			slog.Info("Advertising over mDNS", "name", service.Instance, "port", service.Port)
+			if err := mdns.Advertise(ctx, service); err != nil {
+				slog.Error("Could not advertise over mDNS", "error", err)
+			}
+			return
+		}
+	}
+
+	slog.Warn("Not advertising over mDNS, no listener serves system info over TCP")
+}
+
+// Returns the base64 SHA-256 hash of the certificate's public key, in the same
+// format as the pin that the agent itself uses for tunnel.hub-public-key-sha256
+func publicKeySHA256(certFile, keyFile string) (string, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:]), nil
+}
+
+func cliDiscover() int {
+	fmt.Printf("Looking for agents on the local network for %v...\n", discoverTimeout)
+
+	entries, err := mdns.Browse(context.Background(), mdnsServiceType, discoverTimeout)
+	if err != nil {
+		fmt.Printf("Failed to look for agents: %v\n", err)
+		return 1
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("\nNo agents found, make sure that mdns.enabled is set in their config and that UDP port 5353 isn't blocked")
+		return 0
+	}
+
+	fmt.Printf("\nFound %d agent(s), add the following entries to your servers list in luna.yml:\n\n", len(entries))
+
+	for _, entry := range entries {
+		address := strings.TrimSuffix(entry.Host, ".")
+		if len(entry.IPs) > 0 {
+			address = entry.IPs[0].String()
+		}
+
+		scheme := "http"
+		if entry.TXT["tls-sha256"] != "" {
+			scheme = "https"
+		}
+
+		fmt.Println("- type: remote")
+		fmt.Printf("  name: %s\n", entry.Instance)
+		fmt.Printf("  url: %s://%s\n", scheme, net.JoinHostPort(address, strconv.Itoa(int(entry.Port))))
+		if entry.TXT["auth"] == "token" {
+			fmt.Println("  token: <insert the token from the agent's config>")
+		}
+		if fingerprint := entry.TXT["tls-sha256"]; fingerprint != "" {
+			fmt.Printf("  # TLS public key SHA-256: %s\n", fingerprint)
+		}
+		if version := entry.TXT["version"]; version != "" {
+			fmt.Printf("  # Agent version: %s\n", version)
+		}
+		if len(entry.IPs) > 1 {
+			others := make([]string, 0, len(entry.IPs)-1)
+			for _, ip := range entry.IPs[1:] {
+				others = append(others, ip.String())
+			}
+			fmt.Printf("  # Also reachable at: %s\n", strings.Join(others, ", "))
+		}
+	}
+
+	return 0
+}
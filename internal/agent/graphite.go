@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultGraphitePrefix = "luna_agent"
+
+func validateGraphiteOutput(c *outputConfig) error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return errors.New("address must be in the form of host:port")
+	}
+
+	for key, value := range c.Tags {
+		if strings.ContainsAny(key, ";!^=~ ") || strings.ContainsAny(value, "; ~") || value == "" {
+			return errors.New("graphite tags can't contain any of ; ! ^ = ~ or spaces and can't be empty")
+		}
+	}
+
+	return nil
+}
+
+// Writes metrics in the plaintext protocol of Graphite over TCP, with the name of each metric
+// being the prefix followed by the hostname and the metric's path, e.g. luna_agent.myserver.cpu_load1_percent
+type graphiteWriter struct {
+	address string
+	prefix  string
+	// Already formatted as ;key=value pairs, supported since Graphite 1.1
+	tags string
+}
+
+func newGraphiteWriter(c *outputConfig) metricsWriter {
+	w := &graphiteWriter{
+		address: c.Address,
+		prefix:  strings.TrimSuffix(c.Prefix, "."),
+	}
+
+	if w.prefix == "" {
+		w.prefix = defaultGraphitePrefix
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(c.Tags)) {
+		w.tags += ";" + key + "=" + c.Tags[key]
+	}
+
+	return w
+}
+
+func (w *graphiteWriter) write(ctx context.Context, samples []metricsSample) error {
+	var b bytes.Buffer
+
+	for i := range samples {
+		sample := &samples[i]
+		timestamp := strconv.FormatInt(sample.timestamp.Unix(), 10)
+
+		prefix := w.prefix + "."
+		if sample.hostname != "" {
+			prefix += metricPathSegment(sample.hostname) + "."
+		}
+
+		for j := range sample.metrics {
+			m := &sample.metrics[j]
+			if m.isInfo() {
+				continue
+			}
+
+			b.WriteString(prefix)
+			b.WriteString(metricPath(m, "."))
+			b.WriteString(w.tags)
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+			b.WriteByte(' ')
+			b.WriteString(timestamp)
+			b.WriteByte('\n')
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", w.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	_, err = conn.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGraphiteWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	w := newGraphiteWriter(&outputConfig{Address: listener.Addr().String(), Prefix: "luna.", Tags: map[string]string{"site": "home"}})
+
+	sample := testMetricsSample()
+	sample.metrics = append(sample.metrics, metric{name: "agent_info", value: 1, labels: []metricLabel{{"version", "v1"}}})
+	if err := w.write(context.Background(), []metricsSample{sample}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hostname and label values are escaped into single path segments, and info metrics are left out
+	want := `luna.my_server.cpu_load1_percent;site=home 12 1760000000
+luna.my_server.filesystem_used_percent._mnt_my-20data.a-2cb-3dc;site=home 81.5 1760000000
+luna.my_server.filesystem_used_percent._;site=home 3 1760000000
+`
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was received")
+	}
+}
+
+func TestGraphiteOutputValidate(t *testing.T) {
+	tests := []struct {
+		config  outputConfig
+		wantErr bool
+	}{
+		{outputConfig{Type: "graphite", Address: "localhost:2003", Tags: map[string]string{"site": "home"}}, false},
+		{outputConfig{Type: "graphite", Address: "localhost"}, true},
+		{outputConfig{Type: "graphite", Address: "localhost:2003", Tags: map[string]string{"site": "my home"}}, true},
+		{outputConfig{Type: "graphite", Address: "localhost:2003", Tags: map[string]string{"a=b": "c"}}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.config.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate() of %+v returned %v", test.config, err)
+		}
+	}
+}
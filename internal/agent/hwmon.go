@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const hwmonDir = "/sys/class/hwmon"
+
+const (
+	sensorTypeTemperature = "temperature"
+	sensorTypeFan         = "fan"
+	sensorTypeVoltage     = "voltage"
+	sensorTypePower       = "power"
+)
+
+// The prefix of the sysfs attributes of each type of sensor along with what their values get
+// divided by to get the unit, see https://docs.kernel.org/hwmon/sysfs-interface.html
+var hwmonSensorTypes = []struct {
+	prefix     string
+	sensorType string
+	unit       string
+	divisor    float64
+}{
+	{"temp", sensorTypeTemperature, "celsius", 1000}, // millidegrees
+	{"fan", sensorTypeFan, "rpm", 1},
+	{"in", sensorTypeVoltage, "volts", 1000},     // millivolts
+	{"power", sensorTypePower, "watts", 1000000}, // microwatts
+}
+
+// Entries of system.sensors, keyed by the key of the sensor such as nct6798_fan2
+type sensorConfig struct {
+	// Display name, such as CPU fan
+	Name string `yaml:"name"`
+	Hide bool   `yaml:"hide"`
+}
+
+func (c *collector) collectSensors(info *apiSystemInfo) []error {
+	info.Sensors = []apiSensorInfo{}
+
+	sensors, err := readHwmonSensors()
+	if err != nil {
+		return []error{err}
+	}
+
+	for _, sensor := range sensors {
+		if config, ok := c.config.Sensors[sensor.Key]; ok {
+			if config.Hide {
+				continue
+			}
+			sensor.Name = config.Name
+		}
+		info.Sensors = append(info.Sensors, sensor)
+	}
+
+	return nil
+}
+
+// Reads the sensors of all hwmon devices, which only exist on Linux
+func readHwmonSensors() ([]apiSensorInfo, error) {
+	entries, err := os.ReadDir(hwmonDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// In the order of hwmon10 after hwmon9, since the numbers are assigned as devices get registered
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return compareNumberedNames(a.Name(), b.Name())
+	})
+
+	var sensors []apiSensorInfo
+	keys := map[string]int{}
+
+	for _, entry := range entries {
+		dir := filepath.Join(hwmonDir, entry.Name())
+		chip := readSysfsValue(filepath.Join(dir, "name"))
+		if chip == "" {
+			chip = entry.Name()
+		}
+
+		// Older drivers put the attributes in the directory of the device rather than the hwmon one
+		attributes := hwmonInputAttributes(dir)
+		if len(attributes) == 0 {
+			dir = filepath.Join(dir, "device")
+			attributes = hwmonInputAttributes(dir)
+		}
+
+		for _, attribute := range attributes {
+			sensor, ok := readHwmonSensor(dir, chip, attribute)
+			if !ok {
+				continue
+			}
+
+			// Chips such as nvme show up once for each device, each with the same labels
+			if keys[sensor.Key]++; keys[sensor.Key] > 1 {
+				sensor.Key += "_" + strconv.Itoa(keys[sensor.Key])
+			}
+
+			sensors = append(sensors, sensor)
+		}
+	}
+
+	return sensors, nil
+}
+
+// Returns the names of the sensors in a directory such as temp1 or fan2, ordered by type and number
+func hwmonInputAttributes(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*_input"))
+	// Some drivers such as amdgpu only report the average power
+	averages, _ := filepath.Glob(filepath.Join(dir, "power*_average"))
+
+	var attributes []string
+	for _, file := range append(files, averages...) {
+		attribute, _, _ := strings.Cut(filepath.Base(file), "_")
+		if hwmonSensorType(attribute) != -1 && !slices.Contains(attributes, attribute) {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	slices.SortFunc(attributes, func(a, b string) int {
+		if typeA, typeB := hwmonSensorType(a), hwmonSensorType(b); typeA != typeB {
+			return typeA - typeB
+		}
+		return compareNumberedNames(a, b)
+	})
+
+	return attributes
+}
+
+// Returns the index in hwmonSensorTypes of an attribute such as temp1, or -1 if it isn't one of them
+func hwmonSensorType(attribute string) int {
+	for i, t := range hwmonSensorTypes {
+		number, ok := strings.CutPrefix(attribute, t.prefix)
+		if _, err := strconv.Atoi(number); ok && err == nil {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func readHwmonSensor(dir, chip, attribute string) (apiSensorInfo, bool) {
+	t := hwmonSensorTypes[hwmonSensorType(attribute)]
+	path := func(suffix string) string { return filepath.Join(dir, attribute+"_"+suffix) }
+
+	value, ok := readHwmonValue(path("input"), t.divisor)
+	if !ok && t.sensorType == sensorTypePower {
+		value, ok = readHwmonValue(path("average"), t.divisor)
+	}
+	if !ok {
+		return apiSensorInfo{}, false
+	}
+
+	label := readSysfsValue(path("label"))
+	keySuffix := label
+	if keySuffix == "" {
+		keySuffix = attribute
+	}
+
+	sensor := apiSensorInfo{
+		Key:   sensorKey(chip + " " + keySuffix),
+		Chip:  chip,
+		Label: label,
+		Type:  t.sensorType,
+		Unit:  t.unit,
+		Value: value,
+	}
+	sensor.Max, sensor.MaxIsAvailable = readHwmonValue(path("max"), t.divisor)
+	sensor.Critical, sensor.CriticalIsAvailable = readHwmonValue(path("crit"), t.divisor)
+
+	return sensor, true
+}
+
+// Reading fails for sensors that are disabled or whose device is asleep
+func readHwmonValue(path string, divisor float64) (float64, bool) {
+	value, err := strconv.ParseFloat(readSysfsValue(path), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return value / divisor, true
+}
+
+// Lowercased with spaces replaced by underscores, the same as the keys of cpu-temp-sensor
+func sensorKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "_")
+}
+
+// Compares names such as hwmon2 and hwmon10 by the number they end with when their prefixes are the same
+func compareNumberedNames(a, b string) int {
+	prefixA := strings.TrimRight(a, "0123456789")
+	prefixB := strings.TrimRight(b, "0123456789")
+	if prefixA != prefixB {
+		return strings.Compare(a, b)
+	}
+
+	numberA, _ := strconv.Atoi(a[len(prefixA):])
+	numberB, _ := strconv.Atoi(b[len(prefixB):])
+	return numberA - numberB
+}
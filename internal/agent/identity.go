@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const agentIDFileName = "agent-id"
+
+var agentIDOnce struct {
+	sync.Once
+	id string
+}
+
+// Returns the ID that uniquely identifies this agent to the services it pushes to,
+// which is persisted next to the config file so that it survives restarts and updates.
+// Falls back to an ID that only lasts for the lifetime of the process if it can't be.
+func agentID(configPath string) string {
+	agentIDOnce.Do(func() {
+		path := filepath.Join(filepath.Dir(configPath), agentIDFileName)
+
+		id, err := loadOrCreateAgentID(path)
+		if err != nil {
+			slog.Warn("Could not persist agent ID, a new one will be generated on every start", "path", path, "error", err)
+			id = newAgentID()
+		}
+
+		agentIDOnce.id = id
+	})
+
+	return agentIDOnce.id
+}
+
+func loadOrCreateAgentID(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(contents))
+		if id == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+
+		return id, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := newAgentID()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func newAgentID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
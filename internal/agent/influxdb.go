@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultInfluxDBPrefix = "luna_agent_"
+
+func validateInfluxDBOutput(c *outputConfig) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL, got %q", c.URL)
+	}
+
+	switch c.Version {
+	case 0, 2:
+		if c.Org == "" || c.Bucket == "" {
+			return errors.New("org and bucket are required for InfluxDB v2")
+		}
+	case 1:
+		if c.Database == "" {
+			return errors.New("database is required for InfluxDB v1")
+		}
+	default:
+		return fmt.Errorf("version must be 1 or 2, got %d", c.Version)
+	}
+
+	return nil
+}
+
+// Writes metrics in the line protocol through the HTTP API of InfluxDB v1 or v2, each metric
+// being its own measurement with a single value field and its labels as tags
+type influxDBWriter struct {
+	writeURL string
+	token    string
+	username string
+	password string
+	prefix   string
+	tags     []metricLabel
+	client   *http.Client
+}
+
+func newInfluxDBWriter(c *outputConfig) metricsWriter {
+	w := &influxDBWriter{
+		token:    c.Token,
+		username: c.Username,
+		password: c.Password,
+		prefix:   c.Prefix,
+		client:   &http.Client{},
+	}
+
+	if w.prefix == "" {
+		w.prefix = defaultInfluxDBPrefix
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(c.Tags)) {
+		w.tags = append(w.tags, metricLabel{key, c.Tags[key]})
+	}
+
+	query := url.Values{"precision": {"s"}}
+	path := "/api/v2/write"
+
+	if c.Version == 1 {
+		path = "/write"
+		query.Set("db", c.Database)
+		if c.RetentionPolicy != "" {
+			query.Set("rp", c.RetentionPolicy)
+		}
+	} else {
+		query.Set("org", c.Org)
+		query.Set("bucket", c.Bucket)
+	}
+
+	w.writeURL = strings.TrimSuffix(c.URL, "/") + path + "?" + query.Encode()
+
+	return w
+}
+
+func (w *influxDBWriter) write(ctx context.Context, samples []metricsSample) error {
+	var body bytes.Buffer
+	for i := range samples {
+		w.appendLines(&body, &samples[i])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "luna-agent/"+buildVersion)
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	return nil
+}
+
+func (w *influxDBWriter) appendLines(b *bytes.Buffer, sample *metricsSample) {
+	timestamp := strconv.FormatInt(sample.timestamp.Unix(), 10)
+
+	for i := range sample.metrics {
+		m := &sample.metrics[i]
+
+		b.WriteString(influxDBMeasurementEscaper.Replace(w.prefix + m.name))
+
+		writeTag := func(key, value string) {
+			// Empty tag values aren't allowed
+			if value == "" {
+				return
+			}
+			b.WriteByte(',')
+			b.WriteString(influxDBTagEscaper.Replace(key))
+			b.WriteByte('=')
+			b.WriteString(influxDBTagEscaper.Replace(value))
+		}
+
+		writeTag("host", sample.hostname)
+		for _, l := range m.labels {
+			writeTag(l.name, l.value)
+		}
+		for _, t := range w.tags {
+			writeTag(t.name, t.value)
+		}
+
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(timestamp)
+		b.WriteByte('\n')
+	}
+}
+
+var influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+var influxDBTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
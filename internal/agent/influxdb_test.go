@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMetricsSample() metricsSample {
+	return metricsSample{
+		timestamp: time.Unix(1760000000, 0),
+		hostname:  "my server",
+		metrics: []metric{
+			{name: "cpu_load1_percent", value: 12},
+			{name: "filesystem_used_percent", value: 81.5, labels: []metricLabel{{"path", "/mnt/my data"}, {"name", "a,b=c"}}},
+			{name: "filesystem_used_percent", value: 3, labels: []metricLabel{{"path", "/"}, {"name", ""}}},
+		},
+	}
+}
+
+func TestInfluxDBLines(t *testing.T) {
+	w := newInfluxDBWriter(&outputConfig{Org: "o", Bucket: "b", Tags: map[string]string{"site": "home"}}).(*influxDBWriter)
+
+	var b bytes.Buffer
+	sample := testMetricsSample()
+	w.appendLines(&b, &sample)
+
+	// Spaces, commas and equals signs in tags are escaped, and tags with empty values are left out
+	want := `luna_agent_cpu_load1_percent,host=my\ server,site=home value=12 1760000000
+luna_agent_filesystem_used_percent,host=my\ server,path=/mnt/my\ data,name=a\,b\=c,site=home value=81.5 1760000000
+luna_agent_filesystem_used_percent,host=my\ server,path=/,site=home value=3 1760000000
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInfluxDBWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    outputConfig
+		wantPath  string
+		wantQuery string
+		wantAuth  string
+	}{
+		{
+			name:      "v2",
+			config:    outputConfig{Org: "home", Bucket: "metrics", Token: "abc"},
+			wantPath:  "/api/v2/write",
+			wantQuery: "bucket=metrics&org=home&precision=s",
+			wantAuth:  "Token abc",
+		},
+		{
+			name:      "v1",
+			config:    outputConfig{Version: 1, Database: "metrics", RetentionPolicy: "month", Username: "u", Password: "p"},
+			wantPath:  "/write",
+			wantQuery: "db=metrics&precision=s&rp=month",
+			wantAuth:  "Basic dTpw",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != test.wantPath || r.URL.RawQuery != test.wantQuery {
+					t.Errorf("got request to %s, want %s?%s", r.URL, test.wantPath, test.wantQuery)
+				}
+				if got := r.Header.Get("Authorization"); got != test.wantAuth {
+					t.Errorf("got Authorization %q, want %q", got, test.wantAuth)
+				}
+
+				b, _ := io.ReadAll(r.Body)
+				body = string(b)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			test.config.URL = server.URL
+			samples := []metricsSample{testMetricsSample(), testMetricsSample()}
+			if err := newInfluxDBWriter(&test.config).write(context.Background(), samples); err != nil {
+				t.Fatal(err)
+			}
+
+			if lines := strings.Count(body, "\n"); lines != 6 {
+				t.Errorf("expected 6 lines for the two samples, got %d:\n%s", lines, body)
+			}
+		})
+	}
+}
+
+func TestInfluxDBWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"not found","message":"bucket \"metrics\" not found"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	w := newInfluxDBWriter(&outputConfig{URL: server.URL, Org: "home", Bucket: "metrics"})
+	err := w.write(context.Background(), []metricsSample{testMetricsSample()})
+	if err == nil || !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected an error with the status and message, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/luna-page/agent/internal/systemd"
+)
+
+// Opens the sockets for each of the configured listeners. Sockets passed through systemd
+// socket activation are used in place of listening ourselves and get matched to listeners
+// by their name, unless there's only a single listener in which case they all go to it.
+func openListeners(configs []listenerConfig) ([][]net.Listener, error) {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	opened := make([][]net.Listener, len(configs))
+	closeAll := func() {
+		for i := range opened {
+			for _, l := range opened[i] {
+				l.Close()
+			}
+		}
+	}
+
+	for _, a := range activated {
+		index := 0
+		if len(configs) > 1 {
+			index = slices.IndexFunc(configs, func(c listenerConfig) bool {
+				return c.Name != "" && c.Name == a.Name
+			})
+		}
+
+		if index == -1 {
+			slog.Warn("Closing socket activation listener with no matching listener name", "name", a.Name, "address", a.Addr())
+			a.Close()
+			continue
+		}
+
+		slog.Info("Using socket activation listener", "name", a.Name, "address", a.Addr())
+		opened[index] = append(opened[index], a.Listener)
+	}
+
+	for i := range configs {
+		c := &configs[i]
+
+		if len(opened[i]) == 0 {
+			listener, err := listen(c)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: %v", c.displayName(), err)
+			}
+
+			opened[i] = []net.Listener{listener}
+		}
+
+		if c.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listener %s: loading TLS certificate: %v", c.displayName(), err)
+			}
+
+			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+			for j := range opened[i] {
+				opened[i][j] = tls.NewListener(opened[i][j], tlsConfig)
+			}
+		}
+	}
+
+	return opened, nil
+}
+
+func listen(c *listenerConfig) (net.Listener, error) {
+	if c.UnixSocket != "" {
+		return listenUnix(c.UnixSocket, c.UnixSocketMode, c.UnixSocketOwner)
+	}
+
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port))
+}
+
+func listenUnix(path, mode, owner string) (net.Listener, error) {
+	var perms fs.FileMode
+	if mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return nil, fmt.Errorf("invalid unix socket mode %q, expected an octal value such as 0660", mode)
+		}
+		perms = fs.FileMode(parsed)
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		var err error
+		if uid, gid, err = lookupOwner(owner); err != nil {
+			return nil, err
+		}
+	}
+
+	// A socket left behind by an agent that didn't shut down cleanly would otherwise
+	// make listening fail with "address already in use"
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket %s: %v", path, err)
+		}
+	}
+
+	// The socket gets created with permissions based on the umask, so it's created in a directory
+	// only we can access and moved into place once its mode and owner are set. Otherwise anyone
+	// could connect to it in between, bypassing the restrictions that the mode is meant to apply.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".luna-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("creating directory for socket: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", tempPath)
+	if err != nil {
+		return nil, err
+	}
+	// Removed from where it ends up instead, see unixListener
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	fail := func(err error) (net.Listener, error) {
+		listener.Close()
+		return nil, err
+	}
+
+	if mode != "" {
+		if err := os.Chmod(tempPath, perms); err != nil {
+			return fail(fmt.Errorf("setting mode of %s: %v", path, err))
+		}
+	}
+
+	if owner != "" {
+		if err := os.Chown(tempPath, uid, gid); err != nil {
+			return fail(fmt.Errorf("setting owner of %s: %v", path, err))
+		}
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fail(fmt.Errorf("moving socket to %s: %v", path, err))
+	}
+
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+// A listener whose socket was moved after it started listening
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Parses an owner in the format user, user:group or :group, where both user and
+// group can be either names or numeric IDs. Returns -1 for whichever is omitted.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+
+	if userName != "" {
+		if id, err := strconv.Atoi(userName); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("looking up user %s: %v", userName, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	if groupName != "" {
+		if id, err := strconv.Atoi(groupName); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("looking up group %s: %v", groupName, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	if uid == -1 && gid == -1 {
+		return 0, 0, errors.New("unix socket owner must specify a user, a group or both")
+	}
+
+	return uid, gid, nil
+}
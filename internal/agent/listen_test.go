@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.sock")
+
+	// Left behind by an agent that didn't shut down cleanly
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, "0600", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&fs.ModeSocket == 0 || stat.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want a socket with 0600 permissions", stat.Mode())
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the socket in %s, got %d entries", dir, len(entries))
+	}
+
+	if got := listener.Addr().String(); got != path {
+		t.Errorf("got address %s, want %s", got, path)
+	}
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connecting to the socket: %v", err)
+	}
+	conn.Close()
+
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on close, got %v", err)
+	}
+}
+
+func TestListenUnixRefusesToReplaceFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenUnix(path, "", ""); err == nil {
+		t.Error("expected an error since the path isn't a socket")
+	}
+}
@@ -41,7 +41,9 @@ func Main() int {
 		}
 		return 0
 	case cliIntentPrintSensors:
-		return cliSensorsPrint()
+		return cliSensorsPrint(options.explain, options.configPath)
+	case cliIntentDiscover:
+		return cliDiscover()
 	case cliIntentInstall:
 		if err := install.Init(); err != nil {
 			return 1
@@ -0,0 +1,474 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const bytesPerMB = 1024 * 1024
+
+type metricLabel struct {
+	name  string
+	value string
+}
+
+type metric struct {
+	name   string
+	help   string
+	value  float64
+	labels []metricLabel
+}
+
+// Info metrics only carry labels and always have a value of 1, so they're
+// left out by outputs which can't represent labels on their own
+func (m *metric) isInfo() bool {
+	return strings.HasSuffix(m.name, "_info")
+}
+
+// Returns the name of a metric followed by the values of its labels, joined by separator, e.g.
+// filesystem_used_percent/_mnt_data for outputs that only identify metrics by a path such as
+// MQTT topics or Graphite. Labels without a value are left out at the end, so that a mountpoint
+// without a display name doesn't get an extra segment, and metrics only differing in other
+// labels still end up with different paths.
+func metricPath(m *metric, separator string) string {
+	labels := m.labels
+	for len(labels) > 0 && labels[len(labels)-1].value == "" {
+		labels = labels[:len(labels)-1]
+	}
+
+	var b strings.Builder
+	b.WriteString(m.name)
+	for _, l := range labels {
+		b.WriteString(separator)
+		b.WriteString(escapeMetricPathSegment(l.value))
+	}
+
+	return b.String()
+}
+
+// Turns a label value into a single segment of a metric path, which only contains letters,
+// digits, _ and -, without two values ever ending up as the same segment. / is the most common
+// in values such as mountpoint paths and becomes _, while - gets escaped as --, _ as -_ and
+// everything else as - followed by the hex code of each byte. An empty value becomes -.
+func escapeMetricPathSegment(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := range len(value) {
+		switch c := value[i]; {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+			b.WriteByte(c)
+		case c == '/':
+			b.WriteByte('_')
+		case c == '-':
+			b.WriteString("--")
+		case c == '_':
+			b.WriteString("-_")
+		default:
+			fmt.Fprintf(&b, "-%02x", c)
+		}
+	}
+
+	return b.String()
+}
+
+// Turns a hostname into something that can be used as a single segment of a metric path, which
+// only contains letters, digits, _ and -. Unlike label values, hostnames are kept readable since
+// each agent only has one.
+func metricPathSegment(value string) string {
+	value = strings.Trim(value, "/")
+	if value == "" {
+		return "root"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// Flattens system info into a list of metrics that can be written in whichever
+// format an output expects. Metrics sharing a name are kept next to each other.
+func systemInfoMetrics(info *apiSystemInfo) []metric {
+	var metrics []metric
+
+	add := func(name, help string, value float64, labels ...metricLabel) {
+		metrics = append(metrics, metric{name: name, help: help, value: value, labels: labels})
+	}
+
+	if info.apiHostInfo != nil && info.HostInfoIsAvailable {
+		add("host_info", "Host information, always 1", 1,
+			metricLabel{"hostname", info.Hostname},
+			metricLabel{"platform", info.Platform},
+		)
+		add("boot_time_seconds", "Unix time at which the host booted", float64(info.BootTime))
+	}
+
+	if info.CPU != nil && info.CPU.LoadIsAvailable {
+		add("cpu_load1_percent", "CPU load averaged over 1 minute relative to the core count", float64(info.CPU.Load1Percent))
+		add("cpu_load15_percent", "CPU load averaged over 15 minutes relative to the core count", float64(info.CPU.Load15Percent))
+	}
+
+	if info.CPU != nil && info.CPU.UtilizationIsAvailable {
+		add("cpu_utilization_percent", "Share of time the CPU was busy across all cores", float64(info.CPU.UtilizationPercent))
+	}
+
+	if info.CPU != nil && info.CPU.TemperatureIsAvailable {
+		add("cpu_temperature_celsius", "CPU temperature", float64(info.CPU.TemperatureC))
+	}
+
+	if info.Memory != nil && info.Memory.IsAvailable {
+		add("memory_total_bytes", "Total memory", float64(info.Memory.TotalMB*bytesPerMB))
+		add("memory_used_bytes", "Used memory", float64(info.Memory.UsedMB*bytesPerMB))
+		add("memory_used_percent", "Used memory as a percentage of total memory", float64(info.Memory.UsedPercent))
+	}
+
+	if info.Memory != nil && info.Memory.SwapIsAvailable {
+		add("swap_total_bytes", "Total swap", float64(info.Memory.SwapTotalMB*bytesPerMB))
+		add("swap_used_bytes", "Used swap", float64(info.Memory.SwapUsedMB*bytesPerMB))
+		add("swap_used_percent", "Used swap as a percentage of total swap", float64(info.Memory.SwapUsedPercent))
+	}
+
+	mountpointMetric := func(name, help string, value func(*apiMountpointInfo) float64) {
+		for i := range info.Mountpoints {
+			mp := &info.Mountpoints[i]
+			add(name, help, value(mp), metricLabel{"path", mp.Path}, metricLabel{"name", mp.Name})
+		}
+	}
+
+	mountpointMetric("filesystem_total_bytes", "Total size of the filesystem", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.TotalMB * bytesPerMB)
+	})
+	mountpointMetric("filesystem_used_bytes", "Used space on the filesystem", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.UsedMB * bytesPerMB)
+	})
+	mountpointMetric("filesystem_used_percent", "Used space as a percentage of the filesystem size", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.UsedPercent)
+	})
+	mountpointMetric("filesystem_inodes", "Total inodes of the filesystem", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.InodesTotal)
+	})
+	mountpointMetric("filesystem_inodes_used", "Used inodes of the filesystem", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.InodesUsed)
+	})
+	mountpointMetric("filesystem_inodes_used_percent", "Used inodes as a percentage of the filesystem's inodes", func(mp *apiMountpointInfo) float64 {
+		return float64(mp.InodesUsedPercent)
+	})
+	mountpointMetric("filesystem_read_only", "Whether the filesystem is mounted read-only", func(mp *apiMountpointInfo) float64 {
+		return boolMetricValue(mp.ReadOnly)
+	})
+	mountpointMetric("filesystem_stale", "Whether the filesystem didn't respond in time, in which case the other values are the last known ones", func(mp *apiMountpointInfo) float64 {
+		return boolMetricValue(mp.Stale)
+	})
+
+	for i := range info.Mountpoints {
+		mp := &info.Mountpoints[i]
+		add("filesystem_info", "Filesystem information, always 1", 1,
+			metricLabel{"path", mp.Path},
+			metricLabel{"fs_type", mp.FSType},
+			metricLabel{"device", mp.Device},
+		)
+	}
+
+	for i := range info.ZFS {
+		pool := &info.ZFS[i]
+		label := metricLabel{"pool", pool.Name}
+
+		add("zfs_pool_healthy", "Whether the ZFS pool is ONLINE", boolMetricValue(pool.State == "ONLINE"), label)
+	}
+
+	zfsPoolMetric := func(name, help string, value func(*apiZFSPoolInfo) float64) {
+		for i := range info.ZFS {
+			pool := &info.ZFS[i]
+			if pool.CapacityIsAvailable {
+				add(name, help, value(pool), metricLabel{"pool", pool.Name})
+			}
+		}
+	}
+
+	zfsPoolMetric("zfs_pool_size_bytes", "Raw size of the ZFS pool", func(pool *apiZFSPoolInfo) float64 {
+		return float64(pool.SizeMB * bytesPerMB)
+	})
+	zfsPoolMetric("zfs_pool_allocated_bytes", "Allocated space in the ZFS pool", func(pool *apiZFSPoolInfo) float64 {
+		return float64(pool.AllocatedMB * bytesPerMB)
+	})
+	zfsPoolMetric("zfs_pool_used_percent", "Allocated space as a percentage of the ZFS pool size", func(pool *apiZFSPoolInfo) float64 {
+		return float64(pool.UsedPercent)
+	})
+	zfsPoolMetric("zfs_pool_fragmentation_percent", "Fragmentation of the free space in the ZFS pool", func(pool *apiZFSPoolInfo) float64 {
+		return float64(pool.FragmentationPercent)
+	})
+
+	for i := range info.ZFS {
+		pool := &info.ZFS[i]
+		if pool.ScrubEndTime != 0 {
+			add("zfs_pool_scrub_errors", "Errors found by the last scrub or resilver of the ZFS pool", float64(pool.ScrubErrors), metricLabel{"pool", pool.Name})
+		}
+	}
+
+	// The vdev label comes first and includes the pool, since names such as mirror-0
+	// repeat across pools and outputs such as Graphite only use the first label
+	zfsVdevMetric := func(name, help string, value func(*apiZFSVdevInfo) uint64) {
+		for i := range info.ZFS {
+			pool := &info.ZFS[i]
+			for j := range pool.Vdevs {
+				vdev := &pool.Vdevs[j]
+				add(name, help, float64(value(vdev)), metricLabel{"vdev", pool.Name + "/" + vdev.Name}, metricLabel{"pool", pool.Name})
+			}
+		}
+	}
+
+	zfsVdevMetric("zfs_vdev_read_errors", "Read errors of the ZFS vdev", func(vdev *apiZFSVdevInfo) uint64 { return vdev.ReadErrors })
+	zfsVdevMetric("zfs_vdev_write_errors", "Write errors of the ZFS vdev", func(vdev *apiZFSVdevInfo) uint64 { return vdev.WriteErrors })
+	zfsVdevMetric("zfs_vdev_checksum_errors", "Checksum errors of the ZFS vdev", func(vdev *apiZFSVdevInfo) uint64 { return vdev.ChecksumErrors })
+
+	raidArrayMetric := func(name, help string, value func(*apiRAIDArrayInfo) float64) {
+		for i := range info.RAID {
+			array := &info.RAID[i]
+			add(name, help, value(array), metricLabel{"array", array.Name}, metricLabel{"type", array.Type})
+		}
+	}
+
+	raidArrayMetric("raid_array_degraded", "Whether fewer devices of the RAID array are active than it's made of", func(array *apiRAIDArrayInfo) float64 {
+		return boolMetricValue(array.Degraded)
+	})
+	raidArrayMetric("raid_array_devices", "Number of devices the RAID array is made of", func(array *apiRAIDArrayInfo) float64 {
+		return float64(array.DevicesTotal)
+	})
+	raidArrayMetric("raid_array_active_devices", "Number of active devices in the RAID array", func(array *apiRAIDArrayInfo) float64 {
+		return float64(array.DevicesActive)
+	})
+
+	for i := range info.RAID {
+		array := &info.RAID[i]
+		if array.SyncAction != "" {
+			add("raid_array_sync_progress_percent", "Progress of the ongoing resync, recovery, check or reshape of the RAID array", float64(array.SyncProgressPercent),
+				metricLabel{"array", array.Name},
+				metricLabel{"type", array.Type},
+				metricLabel{"action", array.SyncAction},
+			)
+		}
+	}
+
+	// Like with ZFS vdevs, the device label includes the array
+	// since devids of Btrfs devices repeat across filesystems
+	raidDeviceMetric := func(name, help string, btrfsOnly bool, value func(*apiRAIDDeviceInfo) uint64) {
+		for i := range info.RAID {
+			array := &info.RAID[i]
+			if btrfsOnly && array.Type != raidTypeBtrfs {
+				continue
+			}
+			for j := range array.Devices {
+				device := &array.Devices[j]
+				add(name, help, float64(value(device)), metricLabel{"device", array.Name + "/" + device.Name}, metricLabel{"array", array.Name})
+			}
+		}
+	}
+
+	raidDeviceMetric("raid_device_read_errors", "Read errors of the RAID device, only those that got corrected for md", false, func(device *apiRAIDDeviceInfo) uint64 { return device.ReadErrors })
+	raidDeviceMetric("raid_device_write_errors", "Write errors of the Btrfs device", true, func(device *apiRAIDDeviceInfo) uint64 { return device.WriteErrors })
+	raidDeviceMetric("raid_device_flush_errors", "Flush errors of the Btrfs device", true, func(device *apiRAIDDeviceInfo) uint64 { return device.FlushErrors })
+	raidDeviceMetric("raid_device_corruption_errors", "Checksum mismatches of the Btrfs device", true, func(device *apiRAIDDeviceInfo) uint64 { return device.CorruptionErrors })
+	raidDeviceMetric("raid_device_generation_errors", "Blocks with an unexpected generation on the Btrfs device", true, func(device *apiRAIDDeviceInfo) uint64 { return device.GenerationErrors })
+
+	for i := range info.SMART {
+		device := &info.SMART[i]
+		if device.UpdatedAt != 0 {
+			add("smart_device_info", "SMART device information, always 1", 1,
+				metricLabel{"device", device.Name},
+				metricLabel{"model", device.Model},
+				metricLabel{"serial", device.Serial},
+				metricLabel{"protocol", device.Protocol},
+			)
+		}
+	}
+
+	smartMetric := func(name, help string, include func(*apiSMARTDeviceInfo) bool, value func(*apiSMARTDeviceInfo) float64) {
+		for i := range info.SMART {
+			device := &info.SMART[i]
+			if device.UpdatedAt != 0 && include(device) {
+				add(name, help, value(device), metricLabel{"device", device.Name})
+			}
+		}
+	}
+
+	isATA := func(device *apiSMARTDeviceInfo) bool { return device.Protocol == "ATA" }
+	isNVMe := func(device *apiSMARTDeviceInfo) bool { return device.Protocol == "NVMe" }
+
+	smartMetric("smart_healthy", "Whether the overall SMART health self-assessment of the disk passed",
+		func(device *apiSMARTDeviceInfo) bool { return device.HealthIsAvailable },
+		func(device *apiSMARTDeviceInfo) float64 { return boolMetricValue(device.Healthy) },
+	)
+	smartMetric("smart_temperature_celsius", "Temperature of the disk",
+		func(device *apiSMARTDeviceInfo) bool { return device.TemperatureIsAvailable },
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.TemperatureC) },
+	)
+	smartMetric("smart_power_on_hours", "Hours the disk has been powered on for",
+		func(device *apiSMARTDeviceInfo) bool { return true },
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.PowerOnHours) },
+	)
+	smartMetric("smart_reallocated_sectors", "Sectors of the disk that have been remapped", isATA,
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.ReallocatedSectors) },
+	)
+	smartMetric("smart_pending_sectors", "Unstable sectors of the disk waiting to be remapped", isATA,
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.PendingSectors) },
+	)
+	smartMetric("smart_nvme_used_percent", "Estimate of how much of the NVMe drive's life has been used", isNVMe,
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.NVMeUsedPercent) },
+	)
+	smartMetric("smart_nvme_media_errors", "Unrecovered data integrity errors of the NVMe drive", isNVMe,
+		func(device *apiSMARTDeviceInfo) float64 { return float64(device.NVMeMediaErrors) },
+	)
+
+	// Named after the type and unit of the sensors, e.g. sensor_fan_rpm and sensor_temperature_max_celsius
+	for _, t := range hwmonSensorTypes {
+		sensorMetric := func(kind, help string, include func(*apiSensorInfo) bool, value func(*apiSensorInfo) float64) {
+			name := "sensor_" + t.sensorType + kind + "_" + t.unit
+			for i := range info.Sensors {
+				sensor := &info.Sensors[i]
+				if sensor.Type == t.sensorType && include(sensor) {
+					add(name, help, value(sensor), metricLabel{"key", sensor.Key}, metricLabel{"name", sensor.Name})
+				}
+			}
+		}
+
+		sensorMetric("", "Reading of the "+t.sensorType+" sensor",
+			func(sensor *apiSensorInfo) bool { return true },
+			func(sensor *apiSensorInfo) float64 { return sensor.Value },
+		)
+		sensorMetric("_max", "Upper limit of the "+t.sensorType+" sensor set by the hardware",
+			func(sensor *apiSensorInfo) bool { return sensor.MaxIsAvailable },
+			func(sensor *apiSensorInfo) float64 { return sensor.Max },
+		)
+		sensorMetric("_critical", "Critical limit of the "+t.sensorType+" sensor set by the hardware",
+			func(sensor *apiSensorInfo) bool { return sensor.CriticalIsAvailable },
+			func(sensor *apiSensorInfo) float64 { return sensor.Critical },
+		)
+	}
+
+	if info.Power != nil {
+		for i := range info.Power.RAPL {
+			if domain := &info.Power.RAPL[i]; domain.PowerIsAvailable {
+				add("rapl_power_watts", "Average power drawn by the RAPL domain since the previous collection", domain.PowerW, metricLabel{"domain", domain.Name})
+			}
+		}
+
+		batteryMetric := func(name, help string, include func(*apiBatteryInfo) bool, value func(*apiBatteryInfo) float64) {
+			for i := range info.Power.Batteries {
+				if battery := &info.Power.Batteries[i]; include(battery) {
+					add(name, help, value(battery), metricLabel{"battery", battery.Name})
+				}
+			}
+		}
+
+		batteryMetric("battery_capacity_percent", "Remaining charge of the battery",
+			func(battery *apiBatteryInfo) bool { return battery.CapacityIsAvailable },
+			func(battery *apiBatteryInfo) float64 { return float64(battery.CapacityPercent) },
+		)
+		batteryMetric("battery_charging", "Whether the battery is charging",
+			func(battery *apiBatteryInfo) bool { return true },
+			func(battery *apiBatteryInfo) float64 { return boolMetricValue(battery.Charging) },
+		)
+		batteryMetric("battery_time_remaining_seconds", "Time until the battery is empty while discharging, or full while charging",
+			func(battery *apiBatteryInfo) bool { return battery.TimeRemainingIsAvailable },
+			func(battery *apiBatteryInfo) float64 { return float64(battery.TimeRemainingSeconds) },
+		)
+		batteryMetric("battery_power_watts", "Power the battery is being charged or discharged at",
+			func(battery *apiBatteryInfo) bool { return battery.PowerIsAvailable },
+			func(battery *apiBatteryInfo) float64 { return battery.PowerW },
+		)
+	}
+
+	upsMetric := func(name, help string, include func(*apiUPSInfo) bool, value func(*apiUPSInfo) float64) {
+		for i := range info.UPS {
+			if ups := &info.UPS[i]; ups.Error == "" && include(ups) {
+				add(name, help, value(ups), metricLabel{"ups", ups.Name})
+			}
+		}
+	}
+
+	always := func(ups *apiUPSInfo) bool { return true }
+
+	upsMetric("ups_on_line", "Whether the UPS is running on utility power", always,
+		func(ups *apiUPSInfo) float64 { return boolMetricValue(ups.OnLine) },
+	)
+	upsMetric("ups_on_battery", "Whether the UPS is running on its battery", always,
+		func(ups *apiUPSInfo) float64 { return boolMetricValue(ups.OnBattery) },
+	)
+	upsMetric("ups_low_battery", "Whether the battery of the UPS is low", always,
+		func(ups *apiUPSInfo) float64 { return boolMetricValue(ups.LowBattery) },
+	)
+	upsMetric("ups_battery_charge_percent", "Remaining charge of the UPS's battery",
+		func(ups *apiUPSInfo) bool { return ups.ChargeIsAvailable },
+		func(ups *apiUPSInfo) float64 { return float64(ups.ChargePercent) },
+	)
+	upsMetric("ups_battery_runtime_seconds", "Estimated time the UPS's battery lasts at the current load",
+		func(ups *apiUPSInfo) bool { return ups.RuntimeIsAvailable },
+		func(ups *apiUPSInfo) float64 { return float64(ups.RuntimeSeconds) },
+	)
+	upsMetric("ups_load_percent", "Load as a percentage of the UPS's capacity",
+		func(ups *apiUPSInfo) bool { return ups.LoadIsAvailable },
+		func(ups *apiUPSInfo) float64 { return float64(ups.LoadPercent) },
+	)
+	upsMetric("ups_input_voltage_volts", "Voltage of the utility power going into the UPS",
+		func(ups *apiUPSInfo) bool { return ups.InputVoltageIsAvailable },
+		func(ups *apiUPSInfo) float64 { return ups.InputVoltage },
+	)
+
+	return metrics
+}
+
+func boolMetricValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+const prometheusNamespace = "luna_agent_"
+
+// Writes metrics in the Prometheus text exposition format, all of them as gauges
+func writePrometheusMetrics(w io.Writer, metrics []metric) error {
+	var b strings.Builder
+
+	for i := range metrics {
+		m := &metrics[i]
+
+		if i == 0 || metrics[i-1].name != m.name {
+			fmt.Fprintf(&b, "# HELP %s%s %s\n", prometheusNamespace, m.name, m.help)
+			fmt.Fprintf(&b, "# TYPE %s%s gauge\n", prometheusNamespace, m.name)
+		}
+
+		b.WriteString(prometheusNamespace)
+		b.WriteString(m.name)
+
+		if len(m.labels) > 0 {
+			b.WriteByte('{')
+			for j, l := range m.labels {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(l.name)
+				b.WriteString(`="`)
+				b.WriteString(prometheusLabelEscaper.Replace(l.value))
+				b.WriteByte('"')
+			}
+			b.WriteByte('}')
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(m.value, 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
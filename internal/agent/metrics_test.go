@@ -0,0 +1,56 @@
+package agent
+
+import "testing"
+
+func TestMetricPath(t *testing.T) {
+	tests := []struct {
+		metric metric
+		want   string
+	}{
+		{metric{name: "cpu_temperature_celsius"}, "cpu_temperature_celsius"},
+		{metric{name: "filesystem_used_percent", labels: []metricLabel{{"path", "/"}, {"name", ""}}}, "filesystem_used_percent/_"},
+		{metric{name: "filesystem_used_percent", labels: []metricLabel{{"path", "/mnt/data"}, {"name", ""}}}, "filesystem_used_percent/_mnt_data"},
+		{metric{name: "filesystem_used_percent", labels: []metricLabel{{"path", "/mnt_data"}, {"name", "Data"}}}, "filesystem_used_percent/_mnt-_data/Data"},
+		{metric{name: "raid_array_sync_progress_percent", labels: []metricLabel{{"array", "md0"}, {"type", ""}, {"action", "resync"}}}, "raid_array_sync_progress_percent/md0/-/resync"},
+		{metric{name: "sensor_fan_rpm", labels: []metricLabel{{"key", "nct6798_fan2"}, {"name", "CPU fan"}}}, "sensor_fan_rpm/nct6798-_fan2/CPU-20fan"},
+		{metric{name: "zfs_vdev_read_errors", labels: []metricLabel{{"vdev", "tank/mirror-0"}, {"pool", "tank"}}}, "zfs_vdev_read_errors/tank_mirror--0/tank"},
+		{metric{name: "filesystem_used_percent", labels: []metricLabel{{"path", "/média/ü"}}}, "filesystem_used_percent/_m-c3-a9dia_-c3-bc"},
+	}
+
+	for _, test := range tests {
+		if got := metricPath(&test.metric, "/"); got != test.want {
+			t.Errorf("metricPath(%v) = %q, want %q", test.metric, got, test.want)
+		}
+	}
+}
+
+// Includes values that replacing / and other characters with _ would turn into the same segment
+func TestEscapeMetricPathSegmentIsInjective(t *testing.T) {
+	values := []string{
+		"", "/", "_", "-", "--", "-_", "/_", "_/", "//", "__",
+		"root", "/root", "/mnt/data", "/mnt_data", "/mnt-data", "/mnt.data", "/mnt data", "mnt/data",
+		"-2f", "/2f", "_2f", "a-", "a_", "a/", "a/-", "a_-", "a--", "ü", "-c3-bc",
+	}
+
+	seen := map[string]string{}
+	for _, value := range values {
+		segment := escapeMetricPathSegment(value)
+		if other, exists := seen[segment]; exists {
+			t.Errorf("%q and %q both become %q", value, other, segment)
+		}
+		seen[segment] = value
+
+		for _, c := range segment {
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-') {
+				t.Errorf("%q becomes %q, which contains %q", value, segment, c)
+			}
+		}
+	}
+
+	// Metrics that share a name and first label but differ in another one
+	md := metric{name: "raid_array_degraded", labels: []metricLabel{{"array", "data"}, {"type", "md"}}}
+	btrfs := metric{name: "raid_array_degraded", labels: []metricLabel{{"array", "data"}, {"type", "btrfs"}}}
+	if metricPath(&md, ".") == metricPath(&btrfs, ".") {
+		t.Errorf("md and btrfs arrays with the same name get the same path %q", metricPath(&md, "."))
+	}
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/luna-page/luna/pkg/sysinfo"
+	"gopkg.in/yaml.v3"
+)
+
+// Keys of system.mountpoints are exact paths unless they have one of these prefixes or contain glob characters
+const (
+	mountpointTypeRulePrefix  = "type:"
+	mountpointRegexRulePrefix = "regex:"
+)
+
+// Applied after those from the config, hiding filesystems that don't hold any data of their own
+var defaultMountpointRules = []string{
+	"type:squashfs", // snap packages and live systems
+	"/snap/**",
+	"/var/lib/docker/**",
+	"/var/lib/containers/**",
+	"/run/user/**",
+	// Bind mounted into containers
+	"/etc/hosts",
+	"/etc/hostname",
+	"/etc/resolv.conf",
+}
+
+// A key of system.mountpoints along with what to do with the filesystems it matches
+type mountpointRule struct {
+	key     string
+	request sysinfo.MointpointRequest
+	// Overrides system.network-mounts.timeout for the filesystems this matches when set
+	timeout time.Duration
+
+	// Only one of these is set
+	path    string
+	fsType  string
+	pattern *regexp.Regexp
+}
+
+func newMountpointRule(key string, request sysinfo.MointpointRequest) (mountpointRule, error) {
+	rule := mountpointRule{key: key, request: request}
+
+	if fsType, ok := strings.CutPrefix(key, mountpointTypeRulePrefix); ok {
+		rule.fsType = fsType
+	} else if expr, ok := strings.CutPrefix(key, mountpointRegexRulePrefix); ok {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return rule, fmt.Errorf("invalid regex in %q: %v", key, err)
+		}
+		rule.pattern = pattern
+	} else if strings.ContainsAny(key, "*?[") {
+		pattern, err := globToRegexp(key)
+		if err != nil {
+			return rule, fmt.Errorf("invalid glob %q: %v", key, err)
+		}
+		rule.pattern = pattern
+	} else {
+		rule.path = key
+	}
+
+	return rule, nil
+}
+
+func (r *mountpointRule) matches(path, fsType string) bool {
+	switch {
+	case r.fsType != "":
+		return r.fsType == fsType
+	case r.pattern != nil:
+		return r.pattern.MatchString(path)
+	}
+
+	return r.path == path
+}
+
+// Converts a glob where * matches within a single segment of a path and ** matches across them
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteByte('^')
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			class, n, err := globClassToRegexp(glob[i:])
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(class)
+			i += n - 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
+
+// Converts the bracket expression that glob starts with into a character class, returning
+// it along with the number of bytes it took up. As in shells, a leading ! negates it, a ]
+// right after the opening [ or ! is taken literally and a - between two characters makes
+// a range, while every other character, including \, only stands for itself.
+func globClassToRegexp(glob string) (string, int, error) {
+	var b strings.Builder
+	b.WriteByte('[')
+
+	i := 1
+	if strings.HasPrefix(glob[i:], "!") {
+		// Like * and ?, a negated class doesn't match across segments of a path
+		b.WriteString("^/")
+		i++
+	}
+
+	for start := i; ; {
+		if i >= len(glob) {
+			return "", 0, errors.New("unterminated [")
+		}
+
+		lo, size := utf8.DecodeRuneInString(glob[i:])
+		if lo == ']' && i > start {
+			b.WriteByte(']')
+			return b.String(), i + 1, nil
+		}
+		i += size
+		b.WriteString(quoteClassRune(lo))
+
+		if i+1 < len(glob) && glob[i] == '-' && glob[i+1] != ']' {
+			hi, size := utf8.DecodeRuneInString(glob[i+1:])
+			if hi < lo {
+				return "", 0, fmt.Errorf("invalid range %c-%c", lo, hi)
+			}
+			b.WriteString("-" + quoteClassRune(hi))
+			i += 1 + size
+		}
+	}
+}
+
+// Escapes the characters that have a meaning within a regexp character class
+func quoteClassRune(r rune) string {
+	if strings.ContainsRune(`\[]^-`, r) {
+		return `\` + string(r)
+	}
+
+	return string(r)
+}
+
+// Records the order of the keys of mountpoints, since which rule applies to
+// a filesystem is decided by the first one that matches it
+func (c *systemConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain systemConfig
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	c.mountpointOrder = nil
+	c.mountpointTimeouts = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "mountpoints" {
+			continue
+		}
+		mountpoints := node.Content[i+1]
+		for j := 0; j+1 < len(mountpoints.Content); j += 2 {
+			key := mountpoints.Content[j].Value
+			c.mountpointOrder = append(c.mountpointOrder, key)
+
+			var options struct {
+				Timeout time.Duration `yaml:"timeout"`
+			}
+			if err := mountpoints.Content[j+1].Decode(&options); err != nil {
+				return err
+			}
+			if options.Timeout != 0 {
+				if c.mountpointTimeouts == nil {
+					c.mountpointTimeouts = make(map[string]time.Duration)
+				}
+				c.mountpointTimeouts[key] = options.Timeout
+			}
+		}
+	}
+
+	return nil
+}
+
+// Compiles the rules from mountpoints in the order they were defined in, followed by the default ones
+func (c *systemConfig) compileMountpointRules() error {
+	keys := slices.Clone(c.mountpointOrder)
+	for _, key := range slices.Sorted(maps.Keys(c.Mountpoints)) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	c.mountpointRules = nil
+	for _, key := range keys {
+		rule, err := newMountpointRule(key, c.Mountpoints[key])
+		if err != nil {
+			return fmt.Errorf("system.mountpoints: %v", err)
+		}
+
+		rule.timeout = c.mountpointTimeouts[key]
+		if rule.timeout < 0 {
+			return fmt.Errorf("system.mountpoints: timeout of %q can't be negative, got %v", key, rule.timeout)
+		}
+
+		c.mountpointRules = append(c.mountpointRules, rule)
+	}
+
+	hide := true
+	for _, key := range defaultMountpointRules {
+		rule, err := newMountpointRule(key, sysinfo.MointpointRequest{Hide: &hide})
+		if err != nil {
+			panic(err)
+		}
+		c.mountpointRules = append(c.mountpointRules, rule)
+	}
+
+	return nil
+}
+
+// Returns the first rule matching a filesystem, or nil if none of them do
+func (c *systemConfig) findMountpointRule(path, fsType string) *mountpointRule {
+	for i := range c.mountpointRules {
+		if c.mountpointRules[i].matches(path, fsType) {
+			return &c.mountpointRules[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{"/mnt/*", []string{"/mnt/data", "/mnt/"}, []string{"/mnt/data/sub", "/media/data"}},
+		{"/run/user/**", []string{"/run/user/1000/doc"}, []string{"/run/users"}},
+		{"/mnt/disk?", []string{"/mnt/disk1"}, []string{"/mnt/disk", "/mnt/disk/"}},
+		{"/mnt/disk[0-9]", []string{"/mnt/disk1"}, []string{"/mnt/diska", "/mnt/disk10"}},
+		{"/mnt/[!a]x", []string{"/mnt/bx"}, []string{"/mnt/ax", "/mnt//x"}},
+		// Backslashes and other regexp syntax are taken literally
+		{`/mnt/[\d]`, []string{`/mnt/\`, "/mnt/d"}, []string{"/mnt/1"}},
+		{"/mnt/[^]", []string{"/mnt/^"}, []string{"/mnt/a"}},
+		{"/mnt/[]]", []string{"/mnt/]"}, []string{"/mnt/a"}},
+		{"/mnt/[!]]", []string{"/mnt/a"}, []string{"/mnt/]"}},
+		{"/mnt/[a-]", []string{"/mnt/a", "/mnt/-"}, []string{"/mnt/b"}},
+		{"/mnt/[[]", []string{"/mnt/["}, []string{"/mnt/a"}},
+		{"/mnt/[é]", []string{"/mnt/é"}, []string{"/mnt/e"}},
+		{"/mnt/data.(old)+", []string{"/mnt/data.(old)+"}, []string{"/mnt/dataxold"}},
+	}
+
+	for _, tt := range tests {
+		pattern, err := globToRegexp(tt.glob)
+		if err != nil {
+			t.Errorf("%s: %v", tt.glob, err)
+			continue
+		}
+
+		for _, path := range tt.matches {
+			if !pattern.MatchString(path) {
+				t.Errorf("expected %s to match %s", tt.glob, path)
+			}
+		}
+		for _, path := range tt.misses {
+			if pattern.MatchString(path) {
+				t.Errorf("expected %s not to match %s", tt.glob, path)
+			}
+		}
+	}
+}
+
+func TestInvalidGlobs(t *testing.T) {
+	for _, glob := range []string{"/mnt/[abc", "/mnt/[]", "/mnt/[!", "/mnt/[!]", "/mnt/[z-a]"} {
+		if _, err := globToRegexp(glob); err == nil {
+			t.Errorf("expected %s to be invalid", glob)
+		}
+	}
+}
+
+func TestFirstMatchingMountpointRuleWins(t *testing.T) {
+	config, err := loadTestConfig(t, `
+system:
+  mountpoints:
+    "/mnt/data":
+      name: Data
+    "/mnt/*":
+      hide: true
+    "type:ext4":
+      name: Disk
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		fsType   string
+		wantKey  string
+		wantHide bool
+	}{
+		// Matches all three rules
+		{"/mnt/data", "ext4", "/mnt/data", false},
+		{"/mnt/backup", "ext4", "/mnt/*", true},
+		{"/home", "ext4", "type:ext4", false},
+		// Default rules come after those from the config
+		{"/snap/core/1", "squashfs", "type:squashfs", true},
+	}
+
+	for _, tt := range tests {
+		rule := config.System.findMountpointRule(tt.path, tt.fsType)
+		if rule == nil {
+			t.Errorf("%s: no rule matched", tt.path)
+			continue
+		}
+
+		hide := rule.request.Hide != nil && *rule.request.Hide
+		if rule.key != tt.wantKey || hide != tt.wantHide {
+			t.Errorf("%s: got rule %q with hide %v, want %q with hide %v", tt.path, rule.key, hide, tt.wantKey, tt.wantHide)
+		}
+	}
+
+	// Reversing the order changes which rule applies
+	config, err = loadTestConfig(t, `
+system:
+  mountpoints:
+    "/mnt/*":
+      hide: true
+    "/mnt/data":
+      name: Data
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule := config.System.findMountpointRule("/mnt/data", "ext4"); rule == nil || rule.key != "/mnt/*" {
+		t.Errorf("expected /mnt/* to apply to /mnt/data, got %+v", rule)
+	}
+}
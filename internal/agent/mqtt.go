@@ -0,0 +1,360 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luna-page/agent/internal/mqtt"
+)
+
+const (
+	defaultMQTTInterval        = 10 * time.Second
+	defaultMQTTDiscoveryPrefix = "homeassistant"
+	mqttKeepAlive              = 30 * time.Second
+	maxMQTTBackoff             = 1 * time.Minute
+	mqttStableDuration         = 1 * time.Minute
+)
+
+type mqttConfig struct {
+	// In the form of tcp://host:port or ssl://host:port, publishing is disabled when empty
+	Broker   string `yaml:"broker"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Defaults to luna-agent- followed by the agent ID
+	ClientID string        `yaml:"client-id"`
+	QoS      byte          `yaml:"qos"`
+	Retain   bool          `yaml:"retain"`
+	Interval time.Duration `yaml:"interval"`
+	// Defaults to luna-agent/ followed by the hostname
+	TopicPrefix string `yaml:"topic-prefix"`
+	// Sections to publish the metrics of, all of them when empty
+	Sections []string `yaml:"sections"`
+
+	TLS struct {
+		// Used in place of the system's CAs to verify the broker's certificate
+		CAFile             string `yaml:"ca-file"`
+		InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+	} `yaml:"tls"`
+
+	HomeAssistant struct {
+		Discovery       bool   `yaml:"discovery"`
+		DiscoveryPrefix string `yaml:"discovery-prefix"`
+	} `yaml:"home-assistant"`
+}
+
+func (c *mqttConfig) validate() error {
+	if c.Broker == "" {
+		return nil
+	}
+
+	if _, _, err := c.address(); err != nil {
+		return err
+	}
+
+	if c.QoS > 2 {
+		return fmt.Errorf("mqtt.qos must be 0, 1 or 2, got %d", c.QoS)
+	}
+
+	if c.Interval < 0 {
+		return errors.New("mqtt.interval can't be negative")
+	}
+
+	if err := validateSectionNames(c.Sections); err != nil {
+		return fmt.Errorf("mqtt.sections: %v", err)
+	}
+
+	return nil
+}
+
+// Returns the host:port of the broker and whether to use TLS
+func (c *mqttConfig) address() (string, bool, error) {
+	u, err := url.Parse(c.Broker)
+	if err != nil || u.Hostname() == "" {
+		return "", false, fmt.Errorf("mqtt.broker must be in the form of tcp://host:port or ssl://host:port, got %q", c.Broker)
+	}
+
+	var useTLS bool
+	var defaultPort string
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		defaultPort = "1883"
+	case "ssl", "tls", "mqtts":
+		useTLS, defaultPort = true, "8883"
+	default:
+		return "", false, fmt.Errorf("mqtt.broker has unsupported scheme %q, expected one of: tcp, mqtt, ssl, tls, mqtts", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), useTLS, nil
+}
+
+type mqttPublisher struct {
+	options         *mqtt.Options
+	qos             byte
+	retain          bool
+	interval        time.Duration
+	sections        []string
+	topicPrefix     string
+	discovery       bool
+	discoveryPrefix string
+	agentID         string
+	collector       *collector
+}
+
+func newMQTTPublisher(config *mqttConfig, agentID string, collector *collector) (*mqttPublisher, error) {
+	address, useTLS, err := config.address()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &mqttPublisher{
+		options: &mqtt.Options{
+			Address:   address,
+			ClientID:  config.ClientID,
+			Username:  config.Username,
+			Password:  config.Password,
+			KeepAlive: mqttKeepAlive,
+		},
+		qos:             config.QoS,
+		retain:          config.Retain,
+		interval:        config.Interval,
+		sections:        config.Sections,
+		topicPrefix:     strings.TrimSuffix(config.TopicPrefix, "/"),
+		discovery:       config.HomeAssistant.Discovery,
+		discoveryPrefix: config.HomeAssistant.DiscoveryPrefix,
+		agentID:         agentID,
+		collector:       collector,
+	}
+
+	if useTLS {
+		p.options.TLS = &tls.Config{InsecureSkipVerify: config.TLS.InsecureSkipVerify}
+
+		if config.TLS.CAFile != "" {
+			contents, err := os.ReadFile(config.TLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading mqtt.tls.ca-file: %v", err)
+			}
+
+			p.options.TLS.RootCAs = x509.NewCertPool()
+			if !p.options.TLS.RootCAs.AppendCertsFromPEM(contents) {
+				return nil, errors.New("mqtt.tls.ca-file does not contain any PEM certificates")
+			}
+		}
+	}
+
+	if p.options.ClientID == "" {
+		p.options.ClientID = "luna-agent-" + agentID
+	}
+
+	if p.interval == 0 {
+		p.interval = defaultMQTTInterval
+	}
+
+	if len(p.sections) == 0 {
+		p.sections = sectionNames()
+	}
+
+	if p.discoveryPrefix == "" {
+		p.discoveryPrefix = defaultMQTTDiscoveryPrefix
+	}
+
+	if p.topicPrefix == "" {
+		hostname, _ := os.Hostname()
+		p.topicPrefix = "luna-agent/" + metricPathSegment(hostname)
+	}
+
+	p.options.Will = &mqtt.Message{
+		Topic:   p.availabilityTopic(),
+		Payload: []byte("offline"),
+		QoS:     p.qos,
+		Retain:  true,
+	}
+
+	return p, nil
+}
+
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.topicPrefix + "/status"
+}
+
+func (p *mqttPublisher) run(ctx context.Context) {
+	slog.Info("Publishing system info over MQTT", "broker", p.options.Address, "topic_prefix", p.topicPrefix, "interval", p.interval)
+	backoff := time.Duration(0)
+
+	for {
+		connectedAt := time.Now()
+		err := p.connectAndPublish(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(connectedAt) > mqttStableDuration {
+			backoff = 0
+		}
+
+		backoff = min(max(2*backoff, time.Second), maxMQTTBackoff)
+		wait := backoff + rand.N(backoff/4)
+
+		slog.Warn("MQTT connection lost, reconnecting", "error", err, "retry_in", wait.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (p *mqttPublisher) connectAndPublish(ctx context.Context) error {
+	client, err := mqtt.Connect(ctx, p.options)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if ctx.Err() != nil {
+			// Disconnecting discards the will, so let subscribers know ourselves
+			offlineCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			client.Publish(offlineCtx, &mqtt.Message{Topic: p.availabilityTopic(), Payload: []byte("offline"), QoS: p.qos, Retain: true})
+		}
+		client.Close()
+	}()
+
+	slog.Info("Connected to MQTT broker", "broker", p.options.Address)
+
+	if err := client.Publish(ctx, &mqtt.Message{Topic: p.availabilityTopic(), Payload: []byte("online"), QoS: p.qos, Retain: true}); err != nil {
+		return err
+	}
+
+	// Discovery configs are retained by the broker, so they only need to be
+	// published once per connection and again whenever a new metric shows up
+	discovered := map[string]bool{}
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		info, _ := p.collector.get(p.sections)
+
+		for _, m := range systemInfoMetrics(info) {
+			if m.isInfo() {
+				continue
+			}
+
+			topic := p.topicPrefix + "/" + metricPath(&m, "/")
+
+			if p.discovery && !discovered[topic] {
+				if err := p.publishDiscoveryConfig(ctx, client, info, &m, topic); err != nil {
+					return err
+				}
+				discovered[topic] = true
+			}
+
+			err := client.Publish(ctx, &mqtt.Message{
+				Topic:   topic,
+				Payload: []byte(strconv.FormatFloat(m.value, 'f', -1, 64)),
+				QoS:     p.qos,
+				Retain:  p.retain,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-client.Done():
+			return client.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *mqttPublisher) publishDiscoveryConfig(ctx context.Context, client *mqtt.Client, info *apiSystemInfo, m *metric, topic string) error {
+	nodeID := "luna_agent_" + p.agentID
+	objectID := strings.ReplaceAll(metricPath(m, "/"), "/", "_")
+	deviceName := p.topicPrefix
+	if info.apiHostInfo != nil && info.Hostname != "" {
+		deviceName = info.Hostname
+	}
+
+	name := m.help
+	if len(m.labels) > 0 {
+		name += " (" + m.labels[0].value + ")"
+	}
+
+	config := map[string]any{
+		"name":                  name,
+		"unique_id":             nodeID + "_" + objectID,
+		"state_topic":           topic,
+		"availability_topic":    p.availabilityTopic(),
+		"payload_available":     "online",
+		"payload_not_available": "offline",
+		"device": map[string]any{
+			"identifiers":  []string{nodeID},
+			"name":         deviceName,
+			"manufacturer": "luna",
+			"model":        "luna agent",
+			"sw_version":   buildVersion,
+		},
+	}
+
+	switch {
+	case strings.HasSuffix(m.name, "_celsius"):
+		config["device_class"] = "temperature"
+		config["unit_of_measurement"] = "°C"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_percent"):
+		config["unit_of_measurement"] = "%"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_bytes"):
+		config["device_class"] = "data_size"
+		config["unit_of_measurement"] = "B"
+		config["suggested_unit_of_measurement"] = "GB"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_rpm"):
+		config["unit_of_measurement"] = "RPM"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_volts"):
+		config["device_class"] = "voltage"
+		config["unit_of_measurement"] = "V"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_watts"):
+		config["device_class"] = "power"
+		config["unit_of_measurement"] = "W"
+		config["state_class"] = "measurement"
+	case strings.HasSuffix(m.name, "_time_seconds"):
+		config["device_class"] = "timestamp"
+		config["value_template"] = "{{ value | int | as_datetime }}"
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return client.Publish(ctx, &mqtt.Message{
+		Topic:   p.discoveryPrefix + "/sensor/" + nodeID + "/" + objectID + "/config",
+		Payload: payload,
+		QoS:     p.qos,
+		Retain:  true,
+	})
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/disk"
+)
+
+const defaultNetworkMountTimeout = 2 * time.Second
+
+var networkFilesystemTypes = map[string]struct{}{
+	"nfs":            {},
+	"nfs4":           {},
+	"cifs":           {},
+	"smb3":           {},
+	"smbfs":          {},
+	"ncpfs":          {},
+	"9p":             {},
+	"afs":            {},
+	"ceph":           {},
+	"glusterfs":      {},
+	"lustre":         {},
+	"gpfs":           {},
+	"davfs":          {},
+	"fuse.davfs2":    {},
+	"fuse.sshfs":     {},
+	"fuse.rclone":    {},
+	"fuse.s3fs":      {},
+	"fuse.glusterfs": {},
+	"fuse.cephfs":    {},
+}
+
+type networkMountsConfig struct {
+	// How long to wait for the usage of a network filesystem before reporting it as stale
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *networkMountsConfig) validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("system.network-mounts.timeout can't be negative, got %v", c.Timeout)
+	}
+
+	return nil
+}
+
+// The timeout of the mountpoint rule that applies to the filesystem if it has one,
+// otherwise system.network-mounts.timeout
+func (c *systemConfig) networkMountTimeout(path, fsType string) time.Duration {
+	if rule := c.findMountpointRule(path, fsType); rule != nil && rule.timeout > 0 {
+		return rule.timeout
+	}
+
+	if c.NetworkMounts.Timeout > 0 {
+		return c.NetworkMounts.Timeout
+	}
+
+	return defaultNetworkMountTimeout
+}
+
+func isNetworkFilesystem(fsType string) bool {
+	_, ok := networkFilesystemTypes[fsType]
+	return ok
+}
+
+// FUSE filesystems block the same way network ones do when the process behind them stops responding
+func needsUsageProbe(fsType string) bool {
+	return isNetworkFilesystem(fsType) || fsType == "fuse" || strings.HasPrefix(fsType, "fuse.")
+}
+
+// A statfs call that runs in its own goroutine, since it can block indefinitely
+// on a hung mount and there's no way of interrupting it
+type usageProbe struct {
+	done  chan struct{}
+	usage *disk.UsageStat
+	err   error
+}
+
+type probedMount struct {
+	// The probe that's either still running or the most recent one to have finished
+	probe *usageProbe
+	// From the most recent probe that succeeded, nil if none have
+	lastUsage *disk.UsageStat
+}
+
+func startUsageProbe(path string) *usageProbe {
+	p := &usageProbe{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.usage, p.err = disk.Usage(path)
+	}()
+
+	return p
+}
+
+// Returns the usage of a filesystem that may hang, falling back to the last known usage
+// and reporting it as stale when it doesn't respond within the timeout or returns an error.
+// A mount that's still hung from a previous collection doesn't get probed again and is
+// reported as stale right away, so there's never more than one blocked goroutine per mount
+// and a hung mount only delays the first collection that runs into it.
+func (c *collector) probeMountUsage(path, fsType string) (usage *disk.UsageStat, stale bool, err error) {
+	timeout := c.config.networkMountTimeout(path, fsType)
+
+	if c.probedMounts == nil {
+		c.probedMounts = make(map[string]*probedMount)
+	}
+
+	mount, exists := c.probedMounts[path]
+	if !exists {
+		mount = &probedMount{}
+		c.probedMounts[path] = mount
+	}
+
+	if mount.probe != nil {
+		select {
+		case <-mount.probe.done:
+			mount.probe = nil
+		default:
+			return mount.lastUsage, true, nil
+		}
+	}
+
+	mount.probe = startUsageProbe(path)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-mount.probe.done:
+	case <-timer.C:
+		return mount.lastUsage, true, fmt.Errorf("filesystem did not respond within %v", timeout)
+	}
+
+	if mount.probe.err != nil {
+		return mount.lastUsage, true, mount.probe.err
+	}
+
+	mount.lastUsage = mount.probe.usage
+	return mount.lastUsage, false, nil
+}
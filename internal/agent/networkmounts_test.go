@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetworkMountTimeout(t *testing.T) {
+	config, err := loadTestConfig(t, `
+system:
+  network-mounts:
+    timeout: 5s
+  mountpoints:
+    "/mnt/offsite":
+      name: Offsite
+      timeout: 30s
+    "type:cifs":
+      timeout: 10s
+    "/mnt/*":
+      hide: false
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		fsType string
+		want   time.Duration
+	}{
+		{"/mnt/offsite", "nfs4", 30 * time.Second},
+		{"/mnt/share", "cifs", 10 * time.Second},
+		// The first matching rule applies, which doesn't have a timeout of its own
+		{"/mnt/backup", "nfs4", 5 * time.Second},
+		{"/srv/nfs", "nfs4", 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := config.System.networkMountTimeout(test.path, test.fsType); got != test.want {
+			t.Errorf("networkMountTimeout(%q, %q) = %v, want %v", test.path, test.fsType, got, test.want)
+		}
+	}
+
+	if config.System.Mountpoints["/mnt/offsite"].Name != "Offsite" {
+		t.Error("expected the other options of a mountpoint with a timeout to still apply")
+	}
+
+	if _, err := loadTestConfig(t, "system:\n  mountpoints:\n    /mnt/offsite:\n      timeout: -1s\n"); err == nil {
+		t.Error("expected a negative timeout to be rejected")
+	}
+}
@@ -0,0 +1,317 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNUTPort     = "3493"
+	defaultNUTTimeout  = 5 * time.Second
+	defaultNUTInterval = 5 * time.Second
+)
+
+type nutConfig struct {
+	// host:port of upsd, NUT isn't used when empty
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Names of the UPSes to report, all of those known to upsd when empty
+	UPS     []string      `yaml:"ups"`
+	Timeout time.Duration `yaml:"timeout"`
+	// How often upsd is polled, separately from collecting the section
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c *nutConfig) validate() error {
+	if c.Address == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.address()); err != nil {
+		return fmt.Errorf("system.nut.address must be in the form of host:port, got %q", c.Address)
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("system.nut.timeout can't be negative, got %v", c.Timeout)
+	}
+
+	if c.Interval < 0 {
+		return fmt.Errorf("system.nut.interval can't be negative, got %v", c.Interval)
+	}
+
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("system.nut requires both username and password or neither")
+	}
+
+	return nil
+}
+
+// The port can be left out, in which case the default one of upsd is used
+func (c *nutConfig) address() string {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return net.JoinHostPort(c.Address, defaultNUTPort)
+	}
+
+	return c.Address
+}
+
+func (c *nutConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultNUTInterval
+	}
+
+	return c.Interval
+}
+
+// Only copies the UPSes from the latest poll of upsd, which happens in the background
+// every NUT interval so that an unreachable upsd doesn't hold up the collection
+func (c *collector) collectUPS(info *apiSystemInfo) []error {
+	info.UPS = []apiUPSInfo{}
+	if c.config.NUT.Address == "" {
+		return nil
+	}
+
+	ups, errs := c.ups.get()
+	if ups != nil {
+		info.UPS = ups
+	}
+
+	return errs
+}
+
+func (c *collector) refreshUPS([]apiUPSInfo) ([]apiUPSInfo, []error) {
+	config := &c.config.NUT
+
+	ups, err := readNUT(config)
+	if err != nil {
+		return nil, []error{fmt.Errorf("reading UPSes from upsd at %s: %v", config.address(), err)}
+	}
+
+	var errs []error
+	for i := range ups {
+		if ups[i].Error != "" {
+			errs = append(errs, fmt.Errorf("reading UPS %s: %s", ups[i].Name, ups[i].Error))
+		}
+	}
+
+	return ups, errs
+}
+
+func readNUT(config *nutConfig) ([]apiUPSInfo, error) {
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = defaultNUTTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", config.address(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client := &nutClient{conn: conn, reader: bufio.NewReader(conn)}
+	defer client.command("LOGOUT")
+
+	if config.Username != "" {
+		if _, err := client.command("USERNAME " + nutQuote(config.Username)); err != nil {
+			return nil, fmt.Errorf("logging in: %v", err)
+		}
+		if _, err := client.command("PASSWORD " + nutQuote(config.Password)); err != nil {
+			return nil, fmt.Errorf("logging in: %v", err)
+		}
+	}
+
+	list, err := client.list("UPS")
+	if err != nil {
+		return nil, fmt.Errorf("listing UPSes: %v", err)
+	}
+
+	var devices []apiUPSInfo
+	for _, fields := range list {
+		// UPS <name> "<description>"
+		if len(fields) < 2 {
+			continue
+		}
+		name := fields[1]
+		if len(config.UPS) > 0 && !slices.Contains(config.UPS, name) {
+			continue
+		}
+
+		ups := apiUPSInfo{Name: name}
+		if len(fields) > 2 && fields[2] != "Unavailable" {
+			ups.Description = fields[2]
+		}
+
+		vars, err := client.list("VAR " + nutQuote(name))
+		if err != nil {
+			var nutErr nutError
+			if !errors.As(err, &nutErr) {
+				// The connection is no longer usable
+				return nil, fmt.Errorf("listing variables of %s: %v", name, err)
+			}
+			ups.Error = err.Error()
+			devices = append(devices, ups)
+			continue
+		}
+
+		variables := make(map[string]string, len(vars))
+		for _, fields := range vars {
+			// VAR <ups> <name> "<value>"
+			if len(fields) == 4 {
+				variables[fields[2]] = fields[3]
+			}
+		}
+		parseNUTVariables(&ups, variables)
+
+		devices = append(devices, ups)
+	}
+
+	return devices, nil
+}
+
+// See https://networkupstools.org/docs/developer-guide.chunked/new-drivers.html#_standard_data_names
+func parseNUTVariables(ups *apiUPSInfo, variables map[string]string) {
+	ups.Status = variables["ups.status"]
+	for flag := range strings.FieldsSeq(ups.Status) {
+		switch flag {
+		case "OL":
+			ups.OnLine = true
+		case "OB":
+			ups.OnBattery = true
+		case "LB":
+			ups.LowBattery = true
+		}
+	}
+
+	number := func(name string) (float64, bool) {
+		value, err := strconv.ParseFloat(variables[name], 64)
+		return value, err == nil
+	}
+
+	if charge, ok := number("battery.charge"); ok {
+		ups.ChargeIsAvailable = true
+		ups.ChargePercent = uint8(min(max(charge, 0), 100))
+	}
+
+	if runtime, ok := number("battery.runtime"); ok {
+		ups.RuntimeIsAvailable = true
+		ups.RuntimeSeconds = uint64(max(runtime, 0))
+	}
+
+	if load, ok := number("ups.load"); ok {
+		ups.LoadIsAvailable = true
+		ups.LoadPercent = uint8(min(max(load, 0), 255))
+	}
+
+	if voltage, ok := number("input.voltage"); ok {
+		ups.InputVoltageIsAvailable = true
+		ups.InputVoltage = voltage
+	}
+}
+
+// An error returned by upsd in the form of ERR <message>, such as ERR DATA-STALE,
+// after which the connection can still be used for other commands
+type nutError string
+
+func (e nutError) Error() string {
+	return string(e)
+}
+
+// Implements the parts of the protocol needed to read variables, see
+// https://networkupstools.org/docs/developer-guide.chunked/net-protocol.html
+type nutClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *nutClient) command(command string) ([]string, error) {
+	if _, err := c.conn.Write([]byte(command + "\n")); err != nil {
+		return nil, err
+	}
+
+	return c.readLine()
+}
+
+func (c *nutClient) readLine() ([]string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := splitNUTLine(strings.TrimRight(line, "\r\n"))
+	if len(fields) > 0 && fields[0] == "ERR" {
+		return nil, nutError(strings.Join(fields[1:], " "))
+	}
+
+	return fields, nil
+}
+
+// Sends LIST <query> and returns the fields of each line between BEGIN LIST and END LIST
+func (c *nutClient) list(query string) ([][]string, error) {
+	fields, err := c.command("LIST " + query)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || fields[0] != "BEGIN" || fields[1] != "LIST" {
+		return nil, fmt.Errorf("unexpected response: %s", strings.Join(fields, " "))
+	}
+
+	var lines [][]string
+	for {
+		fields, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) >= 2 && fields[0] == "END" && fields[1] == "LIST" {
+			return lines, nil
+		}
+		lines = append(lines, fields)
+	}
+}
+
+// Splits a line into space separated fields, which can be quoted and have backslash escapes within quotes
+func splitNUTLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, inQuotes, escaped := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case r == ' ' && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields
+}
+
+func nutQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
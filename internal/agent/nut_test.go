@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the variables of the given UPSes the way upsd does, replying with
+// ERR DATA-STALE for UPSes without variables and requiring the password secret
+func startFakeUPSD(t *testing.T, upses map[string][][2]string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeUPSD(conn, upses)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveFakeUPSD(conn net.Conn, upses map[string][][2]string) {
+	defer conn.Close()
+
+	reply := func(line string) { conn.Write([]byte(line + "\n")) }
+	loggedIn := false
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := splitNUTLine(scanner.Text())
+		switch {
+		case len(fields) == 2 && fields[0] == "USERNAME":
+			reply("OK")
+		case len(fields) == 2 && fields[0] == "PASSWORD":
+			if fields[1] != "secret" {
+				reply("ERR INVALID-PASSWORD")
+				continue
+			}
+			loggedIn = true
+			reply("OK")
+		case !loggedIn:
+			reply("ERR ACCESS-DENIED")
+		case len(fields) == 2 && fields[0] == "LIST" && fields[1] == "UPS":
+			reply("BEGIN LIST UPS")
+			reply(`UPS rack "Rack \"A\" UPS"`)
+			reply(`UPS old "Unavailable"`)
+			reply("END LIST UPS")
+		case len(fields) == 3 && fields[0] == "LIST" && fields[1] == "VAR":
+			vars, ok := upses[fields[2]]
+			if !ok {
+				reply("ERR DATA-STALE")
+				continue
+			}
+			reply("BEGIN LIST VAR " + fields[2])
+			for _, v := range vars {
+				reply("VAR " + fields[2] + " " + v[0] + " " + nutQuote(v[1]))
+			}
+			reply("END LIST VAR " + fields[2])
+		case len(fields) == 1 && fields[0] == "LOGOUT":
+			reply("OK Goodbye")
+			return
+		default:
+			reply("ERR UNKNOWN-COMMAND")
+		}
+	}
+}
+
+func TestReadNUT(t *testing.T) {
+	address := startFakeUPSD(t, map[string][][2]string{
+		"rack": {
+			{"ups.status", "OB LB"},
+			{"battery.charge", "18"},
+			{"battery.runtime", "240"},
+			{"ups.load", "37"},
+			{"input.voltage", "0.0"},
+			{"device.mfr", `APC "Smart" \ Co`},
+		},
+	})
+
+	config := &nutConfig{Address: address, Username: "monitor", Password: "secret", Timeout: time.Second}
+	upses, err := readNUT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []apiUPSInfo{
+		{
+			Name:                    "rack",
+			Description:             `Rack "A" UPS`,
+			Status:                  "OB LB",
+			OnBattery:               true,
+			LowBattery:              true,
+			ChargeIsAvailable:       true,
+			ChargePercent:           18,
+			RuntimeIsAvailable:      true,
+			RuntimeSeconds:          240,
+			LoadIsAvailable:         true,
+			LoadPercent:             37,
+			InputVoltageIsAvailable: true,
+		},
+		// The connection keeps getting used after upsd reports an error for a single UPS
+		{Name: "old", Error: "DATA-STALE"},
+	}
+	if !reflect.DeepEqual(upses, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", upses, want)
+	}
+
+	config.UPS = []string{"old"}
+	upses, err = readNUT(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upses) != 1 || upses[0].Name != "old" {
+		t.Errorf("expected only the configured UPS, got %+v", upses)
+	}
+
+	config.Password = "wrong"
+	if _, err := readNUT(config); err == nil || !strings.Contains(err.Error(), "INVALID-PASSWORD") {
+		t.Errorf("expected an error about the password, got %v", err)
+	}
+}
+
+func TestReadNUTUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if _, err := readNUT(&nutConfig{Address: address, Timeout: time.Second}); err == nil {
+		t.Error("expected an error when upsd isn't listening")
+	}
+}
+
+func TestSplitNUTLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"BEGIN LIST UPS", []string{"BEGIN", "LIST", "UPS"}},
+		{`UPS rack "Rack UPS"`, []string{"UPS", "rack", "Rack UPS"}},
+		{`VAR rack device.mfr "APC \"Smart\""`, []string{"VAR", "rack", "device.mfr", `APC "Smart"`}},
+		{`VAR rack ups.id "C:\\UPS"`, []string{"VAR", "rack", "ups.id", `C:\UPS`}},
+		{`VAR rack ups.id ""`, []string{"VAR", "rack", "ups.id", ""}},
+		{"ERR  DATA-STALE ", []string{"ERR", "DATA-STALE"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := splitNUTLine(test.line); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitNUTLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestNUTQuote(t *testing.T) {
+	for _, s := range []string{"plain", `with "quotes"`, `back\slash`, ""} {
+		if got := splitNUTLine(nutQuote(s)); len(got) != 1 || got[0] != s {
+			t.Errorf("quoting %q doesn't round trip, got %q", s, got)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type openAPIOperation struct {
+	path        string
+	summary     string
+	description string
+	// Nil for endpoints that don't return JSON
+	response    any
+	contentType string
+	// Names of the string parameters in path
+	pathParameters []string
+}
+
+var openAPIOperations = append([]openAPIOperation{
+	{
+		path:    apiPrefix + "/sysinfo/all",
+		summary: "Get all system information",
+		description: "Use the fields query parameter with a comma separated list of sections to only receive those sections, " +
+			"for example ?fields=cpu,memory. Available sections: " + strings.Join(sectionNames(), ", ") + ".",
+		response:    apiSystemInfo{},
+		contentType: "application/json",
+	},
+	{
+		path:        apiPrefix + "/healthz",
+		summary:     "Check whether the agent is running",
+		description: "Responds with an empty body and status 200 while the agent is running.",
+	},
+	{
+		path:        "/metrics",
+		summary:     "Get all system information as Prometheus metrics",
+		contentType: "text/plain",
+	},
+	{
+		path:        apiPrefix + "/openapi.json",
+		summary:     "Get this document",
+		contentType: "application/json",
+	},
+	{
+		path:    apiPrefix + "/fleet",
+		summary: "Get the latest system information of all downstream agents",
+		description: "Only available when the agent is configured to aggregate other agents. " +
+			"Responds with whatever was received from each agent's last successful poll along with its status, " +
+			"without waiting on the agents themselves.",
+		response:    apiFleetInfo{},
+		contentType: "application/json",
+	},
+	{
+		path:    apiPrefix + "/fleet/{name}/sysinfo/all",
+		summary: "Get the latest system information of a downstream agent",
+		description: "Responds with status 502 if the agent hasn't been polled successfully yet. " +
+			"Individual sections are available at " + apiPrefix + "/fleet/{name}/sysinfo/{section}.",
+		response:       apiSystemInfo{},
+		contentType:    "application/json",
+		pathParameters: []string{"name"},
+	},
+	{
+		path:           apiPrefix + "/fleet/{name}/healthz",
+		summary:        "Check whether the last poll of a downstream agent succeeded",
+		description:    "Responds with an empty body and status 200 if it did, or 503 if it didn't.",
+		pathParameters: []string{"name"},
+	},
+}, sectionOperations()...)
+
+func sectionOperations() []openAPIOperation {
+	operations := make([]openAPIOperation, len(sections))
+	for i := range sections {
+		operations[i] = openAPIOperation{
+			path:        apiPrefix + "/sysinfo/" + sections[i].name,
+			summary:     "Get the " + sections[i].name + " section of the system information",
+			response:    sections[i].schema,
+			contentType: "application/json",
+		}
+	}
+
+	return operations
+}
+
+var openAPIDocumentJSON = sync.OnceValues(func() ([]byte, error) {
+	return json.MarshalIndent(openAPIDocument(), "", "  ")
+})
+
+func openAPIDocument() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+
+	for _, op := range openAPIOperations {
+		response := map[string]any{"description": "OK"}
+
+		if op.response != nil {
+			response["content"] = map[string]any{
+				op.contentType: map[string]any{
+					"schema": openAPISchemaOf(reflect.TypeOf(op.response), schemas),
+				},
+			}
+		} else if op.contentType != "" {
+			response["content"] = map[string]any{
+				op.contentType: map[string]any{},
+			}
+		}
+
+		operation := map[string]any{
+			"summary": op.summary,
+			"responses": map[string]any{
+				"200": response,
+				"401": map[string]any{"description": "Missing or invalid token"},
+			},
+		}
+		if op.description != "" {
+			operation["description"] = op.description
+		}
+
+		if len(op.pathParameters) > 0 {
+			parameters := make([]any, len(op.pathParameters))
+			for i, name := range op.pathParameters {
+				parameters[i] = map[string]any{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]any{"type": "string"},
+				}
+			}
+			operation["parameters"] = parameters
+		}
+
+		paths[op.path] = map[string]any{"get": operation}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "luna Agent API",
+			"version": apiVersion,
+			"description": "Exposes system information collected by the luna agent. " +
+				"Agent version " + buildVersion + ".",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"token": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Only required if a token is set in the agent's config",
+				},
+			},
+		},
+		"security": []any{
+			map[string]any{},
+			map[string]any{"token": []string{}},
+		},
+	}
+}
+
+// Builds the schema for a type based on its JSON encoding. Named struct types are added
+// to schemas and referenced, using their name without the api prefix.
+func openAPISchemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return openAPISchemaOf(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": openAPISchemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "api")
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, exists := schemas[name]; exists {
+			return ref
+		}
+
+		properties := map[string]any{}
+		required := []string{}
+		// Set before adding the properties in case the type references itself
+		schemas[name] = map[string]any{}
+		openAPIAddStructProperties(t, properties, &required, false, schemas)
+
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		schemas[name] = schema
+
+		return ref
+	}
+
+	return map[string]any{}
+}
+
+func openAPIAddStructProperties(t reflect.Type, properties map[string]any, required *[]string, optional bool, schemas map[string]any) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+
+		// Fields of embedded structs get promoted to the parent object and
+		// are left out entirely when the embedded struct is a nil pointer
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+				openAPIAddStructProperties(embedded, properties, required, true, schemas)
+			} else {
+				openAPIAddStructProperties(embedded, properties, required, optional, schemas)
+			}
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := openAPISchemaOf(field.Type, schemas)
+		if doc := field.Tag.Get("doc"); doc != "" {
+			if _, isRef := schema["$ref"]; isRef {
+				// Siblings of $ref are ignored in OpenAPI 3.0
+				schema = map[string]any{"allOf": []any{schema}, "description": doc}
+			} else {
+				schema["description"] = doc
+			}
+		}
+		properties[name] = schema
+
+		if !optional && !strings.Contains(options, "omitempty") && !strings.Contains(options, "omitzero") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpEncodingProtobuf = "protobuf"
+	otlpEncodingJSON     = "json"
+	otlpDefaultPrefix    = "luna_agent."
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	otlpTemporalityCumulative = 2
+)
+
+func validateOTLPOutput(c *outputConfig) error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL, got %q", c.URL)
+	}
+
+	if c.Encoding != "" && c.Encoding != otlpEncodingProtobuf && c.Encoding != otlpEncodingJSON {
+		return fmt.Errorf("encoding must be %s or %s, got %q", otlpEncodingProtobuf, otlpEncodingJSON, c.Encoding)
+	}
+
+	return nil
+}
+
+// Exports metrics over OTLP/HTTP, using the names from OpenTelemetry's semantic conventions
+// for system metrics where there is one and the prefix followed by our own name otherwise
+type otlpWriter struct {
+	url       string
+	encoding  string
+	headers   map[string]string
+	prefix    string
+	startTime time.Time
+	client    *http.Client
+}
+
+func newOTLPWriter(c *outputConfig) metricsWriter {
+	w := &otlpWriter{
+		url:       c.URL,
+		encoding:  c.Encoding,
+		headers:   c.Headers,
+		prefix:    c.Prefix,
+		startTime: time.Now(),
+		client:    &http.Client{},
+	}
+
+	// Same as OTEL_EXPORTER_OTLP_ENDPOINT, the path is only appended when there isn't one already
+	if u, _ := url.Parse(c.URL); u.Path == "" || u.Path == "/" {
+		w.url = strings.TrimSuffix(c.URL, "/") + "/v1/metrics"
+	}
+
+	if w.encoding == "" {
+		w.encoding = otlpEncodingProtobuf
+	}
+
+	if w.prefix == "" {
+		w.prefix = otlpDefaultPrefix
+	}
+
+	return w
+}
+
+type otlpAttribute struct {
+	key   string
+	value string
+}
+
+type otlpDataPoint struct {
+	attributes []otlpAttribute
+	value      float64
+}
+
+type otlpMetric struct {
+	name        string
+	description string
+	unit        string
+	// Non-monotonic cumulative sum, i.e. an UpDownCounter, instead of a gauge
+	sum        bool
+	dataPoints []otlpDataPoint
+}
+
+type otlpResourceMetrics struct {
+	attributes []otlpAttribute
+	timestamp  time.Time
+	metrics    []otlpMetric
+}
+
+func (w *otlpWriter) write(ctx context.Context, samples []metricsSample) error {
+	resources := make([]otlpResourceMetrics, len(samples))
+	for i := range samples {
+		resources[i] = w.resourceMetrics(&samples[i])
+	}
+
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+
+	if w.encoding == otlpEncodingJSON {
+		contentType = "application/json"
+		body, err = json.Marshal(w.jsonRequest(resources))
+		if err != nil {
+			return err
+		}
+	} else {
+		body = w.protobufRequest(resources)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "luna-agent/"+buildVersion)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	return nil
+}
+
+// Maps the flat metrics of a sample to their semantic convention counterparts, some of which
+// are split by a state attribute and therefore need the free amount worked out from the total
+func (w *otlpWriter) resourceMetrics(sample *metricsSample) otlpResourceMetrics {
+	resource := otlpResourceMetrics{
+		timestamp: sample.timestamp,
+		attributes: []otlpAttribute{
+			{"service.name", "luna-agent"},
+			{"service.version", buildVersion},
+			{"os.type", runtime.GOOS},
+		},
+	}
+
+	if sample.hostname != "" {
+		resource.attributes = append(resource.attributes, otlpAttribute{"host.name", sample.hostname})
+	}
+
+	metrics := map[string]*otlpMetric{}
+	var order []string
+
+	add := func(name, description, unit string, sum bool, value float64, attributes ...otlpAttribute) {
+		m, exists := metrics[name]
+		if !exists {
+			m = &otlpMetric{name: name, description: description, unit: unit, sum: sum}
+			metrics[name] = m
+			order = append(order, name)
+		}
+
+		m.dataPoints = append(m.dataPoints, otlpDataPoint{attributes: attributes, value: value})
+	}
+
+	// Totals keyed by metric name and labels, to work out free amounts from used ones
+	totals := map[string]float64{}
+	for _, m := range sample.metrics {
+		if strings.HasSuffix(m.name, "_total_bytes") {
+			totals[metricPath(&m, "/")] = m.value
+		}
+	}
+
+	// Attributes describing each filesystem, keyed by mountpoint
+	filesystems := map[string]*otlpFilesystem{}
+	filesystem := func(path string) *otlpFilesystem {
+		if filesystems[path] == nil {
+			filesystems[path] = &otlpFilesystem{}
+		}
+		return filesystems[path]
+	}
+	for _, m := range sample.metrics {
+		switch m.name {
+		case "filesystem_info":
+			for _, l := range m.labels {
+				switch l.name {
+				case "fs_type":
+					filesystem(m.labels[0].value).fsType = l.value
+				case "device":
+					filesystem(m.labels[0].value).device = l.value
+				}
+			}
+		case "filesystem_read_only":
+			mode := "rw"
+			if m.value == 1 {
+				mode = "ro"
+			}
+			filesystem(m.labels[0].value).mode = mode
+		}
+	}
+
+	free := func(m *metric) float64 {
+		total := metricPath(&metric{name: strings.Replace(m.name, "_used_", "_total_", 1), labels: m.labels}, "/")
+		return max(totals[total]-m.value, 0)
+	}
+
+	for _, m := range sample.metrics {
+		switch m.name {
+		case "host_info":
+			for _, l := range m.labels {
+				if l.name == "platform" && l.value != "" {
+					resource.attributes = append(resource.attributes, otlpAttribute{"os.name", l.value})
+				}
+			}
+		case "boot_time_seconds":
+			add("system.uptime", "The time the system has been running", "s", false, float64(sample.timestamp.Unix())-m.value)
+		case "cpu_utilization_percent":
+			add("system.cpu.utilization", "Share of time the CPU was busy across all cores", "1", false, m.value/100)
+		case "memory_total_bytes":
+			add("system.memory.limit", "Total memory available in the system", "By", true, m.value)
+		case "memory_used_bytes":
+			add("system.memory.usage", "Reports memory in use by state", "By", true, m.value, otlpAttribute{"system.memory.state", "used"})
+			add("system.memory.usage", "", "", true, free(&m), otlpAttribute{"system.memory.state", "free"})
+		case "memory_used_percent":
+			add("system.memory.utilization", "Reports memory in use by state as a fraction of the total", "1", false, m.value/100, otlpAttribute{"system.memory.state", "used"})
+		case "swap_total_bytes":
+			// Same as the sum of system.paging.usage, which doesn't have a limit counterpart
+		case "swap_used_bytes":
+			add("system.paging.usage", "Reports swap space in use by state", "By", true, m.value, otlpAttribute{"system.paging.state", "used"})
+			add("system.paging.usage", "", "", true, free(&m), otlpAttribute{"system.paging.state", "free"})
+		case "swap_used_percent":
+			add("system.paging.utilization", "Reports swap space in use by state as a fraction of the total", "1", false, m.value/100, otlpAttribute{"system.paging.state", "used"})
+		case "filesystem_total_bytes":
+			add("system.filesystem.limit", "The total storage capacity of the filesystem", "By", true, m.value, otlpMountpointAttributes(&m, filesystems)...)
+		case "filesystem_used_bytes":
+			add("system.filesystem.usage", "Reports a filesystem's space usage across different states", "By", true, m.value,
+				append(otlpMountpointAttributes(&m, filesystems), otlpAttribute{"system.filesystem.state", "used"})...)
+			add("system.filesystem.usage", "", "", true, free(&m),
+				append(otlpMountpointAttributes(&m, filesystems), otlpAttribute{"system.filesystem.state", "free"})...)
+		case "filesystem_used_percent":
+			add("system.filesystem.utilization", "Fraction of the filesystem's space that is in use", "1", false, m.value/100,
+				append(otlpMountpointAttributes(&m, filesystems), otlpAttribute{"system.filesystem.state", "used"})...)
+		default:
+			if m.isInfo() {
+				continue
+			}
+
+			attributes := make([]otlpAttribute, 0, len(m.labels))
+			for _, l := range m.labels {
+				attributes = append(attributes, otlpAttribute{l.name, l.value})
+			}
+			add(w.prefix+m.name, m.help, otlpUnit(m.name), false, m.value, attributes...)
+		}
+	}
+
+	for _, name := range order {
+		resource.metrics = append(resource.metrics, *metrics[name])
+	}
+
+	return resource
+}
+
+// Returns the UCUM unit of a metric that has no semantic convention counterpart, based on its name
+func otlpUnit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_percent"):
+		return "%"
+	case strings.HasSuffix(name, "_celsius"):
+		return "Cel"
+	case strings.HasSuffix(name, "_bytes"):
+		return "By"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_rpm"):
+		return "{rotation}/min"
+	case strings.HasSuffix(name, "_volts"):
+		return "V"
+	case strings.HasSuffix(name, "_watts"):
+		return "W"
+	}
+
+	return ""
+}
+
+type otlpFilesystem struct {
+	device string
+	fsType string
+	mode   string
+}
+
+func otlpMountpointAttributes(m *metric, filesystems map[string]*otlpFilesystem) []otlpAttribute {
+	for _, l := range m.labels {
+		if l.name != "path" {
+			continue
+		}
+
+		attributes := []otlpAttribute{{"system.filesystem.mountpoint", l.value}}
+		if fs := filesystems[l.value]; fs != nil {
+			for _, a := range []otlpAttribute{
+				{"system.device", fs.device},
+				{"system.filesystem.type", fs.fsType},
+				{"system.filesystem.mode", fs.mode},
+			} {
+				if a.value != "" {
+					attributes = append(attributes, a)
+				}
+			}
+		}
+
+		return attributes
+	}
+
+	return nil
+}
+
+// Field names and numbers below follow opentelemetry/proto/collector/metrics/v1/metrics_service.proto
+
+func (w *otlpWriter) jsonRequest(resources []otlpResourceMetrics) map[string]any {
+	jsonAttributes := func(attributes []otlpAttribute) []any {
+		result := make([]any, len(attributes))
+		for i, a := range attributes {
+			result[i] = map[string]any{"key": a.key, "value": map[string]any{"stringValue": a.value}}
+		}
+		return result
+	}
+
+	resourceMetrics := make([]any, len(resources))
+	for i := range resources {
+		r := &resources[i]
+		metrics := make([]any, len(r.metrics))
+
+		for j := range r.metrics {
+			m := &r.metrics[j]
+			dataPoints := make([]any, len(m.dataPoints))
+
+			for k, p := range m.dataPoints {
+				point := map[string]any{
+					"attributes":   jsonAttributes(p.attributes),
+					"timeUnixNano": strconv.FormatInt(r.timestamp.UnixNano(), 10),
+					"asDouble":     p.value,
+				}
+				if m.sum {
+					point["startTimeUnixNano"] = strconv.FormatInt(w.startTime.UnixNano(), 10)
+				}
+				dataPoints[k] = point
+			}
+
+			metric := map[string]any{"name": m.name, "description": m.description, "unit": m.unit}
+			if m.sum {
+				metric["sum"] = map[string]any{
+					"dataPoints":             dataPoints,
+					"aggregationTemporality": otlpTemporalityCumulative,
+					"isMonotonic":            false,
+				}
+			} else {
+				metric["gauge"] = map[string]any{"dataPoints": dataPoints}
+			}
+			metrics[j] = metric
+		}
+
+		resourceMetrics[i] = map[string]any{
+			"resource": map[string]any{"attributes": jsonAttributes(r.attributes)},
+			"scopeMetrics": []any{map[string]any{
+				"scope":   map[string]any{"name": "github.com/luna-page/agent", "version": buildVersion},
+				"metrics": metrics,
+			}},
+		}
+	}
+
+	return map[string]any{"resourceMetrics": resourceMetrics}
+}
+
+func (w *otlpWriter) protobufRequest(resources []otlpResourceMetrics) []byte {
+	appendAttributes := func(b []byte, field int, attributes []otlpAttribute) []byte {
+		for _, a := range attributes {
+			value := protobufAppendString(nil, 1, a.value) // AnyValue.string_value
+			keyValue := protobufAppendString(nil, 1, a.key)
+			keyValue = protobufAppendBytes(keyValue, 2, value)
+			b = protobufAppendBytes(b, field, keyValue)
+		}
+		return b
+	}
+
+	var request []byte
+	for i := range resources {
+		r := &resources[i]
+
+		scope := protobufAppendString(nil, 1, "github.com/luna-page/agent")
+		scope = protobufAppendString(scope, 2, buildVersion)
+		scopeMetrics := protobufAppendBytes(nil, 1, scope)
+
+		for j := range r.metrics {
+			m := &r.metrics[j]
+
+			var data []byte
+			for _, p := range m.dataPoints {
+				var point []byte
+				if m.sum {
+					point = protobufAppendFixed64(point, 2, uint64(w.startTime.UnixNano()))
+				}
+				point = protobufAppendFixed64(point, 3, uint64(r.timestamp.UnixNano()))
+				point = protobufAppendFixed64(point, 4, math.Float64bits(p.value))
+				point = appendAttributes(point, 7, p.attributes)
+				data = protobufAppendBytes(data, 1, point)
+			}
+
+			metric := protobufAppendString(nil, 1, m.name)
+			metric = protobufAppendString(metric, 2, m.description)
+			metric = protobufAppendString(metric, 3, m.unit)
+			if m.sum {
+				data = protobufAppendVarint(data, 2, otlpTemporalityCumulative)
+				// is_monotonic is false, which is the default and therefore left out
+				metric = protobufAppendBytes(metric, 7, data)
+			} else {
+				metric = protobufAppendBytes(metric, 5, data)
+			}
+
+			scopeMetrics = protobufAppendBytes(scopeMetrics, 2, metric)
+		}
+
+		resource := appendAttributes(nil, 1, r.attributes)
+		resourceMetrics := protobufAppendBytes(nil, 1, resource)
+		resourceMetrics = protobufAppendBytes(resourceMetrics, 2, scopeMetrics)
+		request = protobufAppendBytes(request, 1, resourceMetrics)
+	}
+
+	return request
+}
+
+const (
+	protobufWireVarint  = 0
+	protobufWireFixed64 = 1
+	protobufWireBytes   = 2
+)
+
+func protobufAppendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func protobufAppendVarint(b []byte, field int, value uint64) []byte {
+	b = protobufAppendTag(b, field, protobufWireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func protobufAppendFixed64(b []byte, field int, value uint64) []byte {
+	b = protobufAppendTag(b, field, protobufWireFixed64)
+	return binary.LittleEndian.AppendUint64(b, value)
+}
+
+func protobufAppendBytes(b []byte, field int, value []byte) []byte {
+	b = protobufAppendTag(b, field, protobufWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protobufAppendString(b []byte, field int, value string) []byte {
+	if value == "" {
+		return b
+	}
+	return protobufAppendBytes(b, field, []byte(value))
+}
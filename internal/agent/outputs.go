@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOutputInterval   = 10 * time.Second
+	defaultOutputTimeout    = 10 * time.Second
+	defaultOutputBufferSize = 360
+	maxOutputBatchSize      = 60
+	maxOutputBackoff        = 5 * time.Minute
+)
+
+// Options for all output types are kept in a single struct, with
+// each type only using the ones that are relevant to it
+type outputConfig struct {
+	Type       string        `yaml:"type"`
+	Interval   time.Duration `yaml:"interval"`
+	Timeout    time.Duration `yaml:"timeout"`
+	BufferSize int           `yaml:"buffer-size"`
+	// Prepended to metric names, the default depends on the type
+	Prefix string `yaml:"prefix"`
+	// Added to every metric
+	Tags map[string]string `yaml:"tags"`
+	// Sections to write the metrics of, all of them when empty
+	Sections []string `yaml:"sections"`
+
+	// InfluxDB
+	URL             string `yaml:"url"`
+	Version         int    `yaml:"version"`
+	Token           string `yaml:"token"`
+	Org             string `yaml:"org"`
+	Bucket          string `yaml:"bucket"`
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention-policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+
+	// Graphite and StatsD
+	Address string `yaml:"address"`
+
+	// StatsD
+	DogStatsD     bool `yaml:"dogstatsd"`
+	MaxPacketSize int  `yaml:"max-packet-size"`
+
+	// OTLP, which also uses URL
+	Encoding string            `yaml:"encoding"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+// Sends batches of samples to wherever an output is meant to deliver metrics
+type metricsWriter interface {
+	write(ctx context.Context, samples []metricsSample) error
+}
+
+type metricsSample struct {
+	timestamp time.Time
+	hostname  string
+	metrics   []metric
+}
+
+type outputType struct {
+	validate  func(c *outputConfig) error
+	newWriter func(c *outputConfig) metricsWriter
+	// Whether to write the latest sample after every collection instead of buffering samples
+	// and retrying them, for when only the current values are worth writing
+	writesEveryCollection bool
+}
+
+var outputTypes = map[string]outputType{
+	"influxdb": {validateInfluxDBOutput, newInfluxDBWriter, false},
+	"graphite": {validateGraphiteOutput, newGraphiteWriter, false},
+	"otlp":     {validateOTLPOutput, newOTLPWriter, false},
+	"statsd":   {validateStatsDOutput, newStatsDWriter, true},
+}
+
+func (c *outputConfig) validate() error {
+	t, exists := outputTypes[c.Type]
+	if !exists {
+		types := make([]string, 0, len(outputTypes))
+		for name := range outputTypes {
+			types = append(types, name)
+		}
+		slices.Sort(types)
+
+		return fmt.Errorf("unknown type %q, expected one of: %s", c.Type, strings.Join(types, ", "))
+	}
+
+	if c.Interval < 0 || c.Timeout < 0 || c.BufferSize < 0 {
+		return errors.New("interval, timeout and buffer-size can't be negative")
+	}
+
+	for key := range c.Tags {
+		if key == "" {
+			return errors.New("tags can't have an empty name")
+		}
+	}
+
+	if t.writesEveryCollection && (c.Interval != 0 || c.BufferSize != 0) {
+		return fmt.Errorf("interval and buffer-size aren't supported by %s outputs, which write after every collection", c.Type)
+	}
+
+	if err := validateSectionNames(c.Sections); err != nil {
+		return fmt.Errorf("sections: %v", err)
+	}
+
+	return t.validate(c)
+}
+
+// Periodically collects metrics and hands them to a writer, keeping those that couldn't
+// be written to retry them along with later ones, unless the type writes every collection
+type metricsOutput struct {
+	name      string
+	writer    metricsWriter
+	timeout   time.Duration
+	sections  []string
+	collector *collector
+	// Nil for types that write every collection
+	delivery *bufferedDelivery[metricsSample]
+}
+
+func newMetricsOutput(config *outputConfig, collector *collector) *metricsOutput {
+	o := &metricsOutput{
+		name:      config.Type,
+		writer:    outputTypes[config.Type].newWriter(config),
+		timeout:   config.Timeout,
+		sections:  config.Sections,
+		collector: collector,
+	}
+
+	if o.timeout == 0 {
+		o.timeout = defaultOutputTimeout
+	}
+
+	if len(o.sections) == 0 {
+		o.sections = sectionNames()
+	}
+
+	if outputTypes[config.Type].writesEveryCollection {
+		return o
+	}
+
+	o.delivery = &bufferedDelivery[metricsSample]{
+		interval:        config.Interval,
+		bufferSize:      config.BufferSize,
+		batchSize:       maxOutputBatchSize,
+		maxBackoff:      maxOutputBackoff,
+		failureMessage:  "Could not write metrics",
+		recoveryMessage: "Writing metrics succeeded again",
+		logger:          slog.With("output", o.name),
+		sample:          o.sample,
+		deliver:         o.write,
+	}
+
+	if o.delivery.interval == 0 {
+		o.delivery.interval = defaultOutputInterval
+	}
+
+	if o.delivery.bufferSize == 0 {
+		o.delivery.bufferSize = defaultOutputBufferSize
+	}
+
+	return o
+}
+
+func (o *metricsOutput) run(ctx context.Context) {
+	if o.delivery == nil {
+		slog.Info("Writing metrics after every collection", "output", o.name)
+		o.writeEveryCollection(ctx)
+		return
+	}
+
+	slog.Info("Writing metrics", "output", o.name, "interval", o.delivery.interval)
+	o.delivery.run(ctx)
+}
+
+// Writes the latest sample after each collection, dropping it if that fails
+func (o *metricsOutput) writeEveryCollection(ctx context.Context) {
+	collections := o.collector.subscribe()
+	failing := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-collections:
+		}
+
+		if err := o.write(ctx, []metricsSample{o.sample()}); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Only logged once until it works again, since this is attempted after every collection
+			if !failing {
+				slog.Warn("Could not write metrics", "output", o.name, "error", err)
+			}
+			failing = true
+		} else {
+			if failing {
+				slog.Info("Writing metrics succeeded again", "output", o.name)
+			}
+			failing = false
+		}
+	}
+}
+
+func (o *metricsOutput) sample() metricsSample {
+	info, collectedAt := o.collector.get(o.sections)
+
+	sample := metricsSample{timestamp: collectedAt, metrics: systemInfoMetrics(info)}
+	// Identifies the series of this host, so it's needed even when the host section isn't written
+	if info.apiHostInfo != nil && info.Hostname != "" {
+		sample.hostname = info.Hostname
+	} else {
+		sample.hostname, _ = os.Hostname()
+	}
+
+	return sample
+}
+
+func (o *metricsOutput) write(ctx context.Context, batch []metricsSample) error {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	return o.writer.write(ctx, batch)
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	powercapDir    = "/sys/class/powercap"
+	powerSupplyDir = "/sys/class/power_supply"
+)
+
+// An energy counter reading of a RAPL domain, kept until the next
+// collection to calculate the power used between the two
+type raplSample struct {
+	energyUJ uint64
+	at       time.Time
+}
+
+func (c *collector) collectPower(info *apiSystemInfo) []error {
+	var errs []error
+	info.Power = &apiPowerInfo{
+		RAPL:      []apiRAPLDomainInfo{},
+		Batteries: []apiBatteryInfo{},
+	}
+
+	domains, raplErrs := c.readRAPLDomains()
+	errs = append(errs, raplErrs...)
+	info.Power.RAPL = append(info.Power.RAPL, domains...)
+
+	batteries, err := readBatteries()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading batteries: %v", err))
+	}
+	info.Power.Batteries = append(info.Power.Batteries, batteries...)
+
+	return errs
+}
+
+// Reads the energy counters of the Intel RAPL domains, which AMD processors also expose
+// through the same driver, and calculates the power from the previous collection's readings
+func (c *collector) readRAPLDomains() ([]apiRAPLDomainInfo, []error) {
+	dirs, _ := filepath.Glob(filepath.Join(powercapDir, "intel-rapl:*"))
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+
+	// Subdomains such as intel-rapl:0:2 come right after their package intel-rapl:0
+	slices.Sort(dirs)
+
+	if c.raplSamples == nil {
+		c.raplSamples = make(map[string]raplSample)
+	}
+
+	var domains []apiRAPLDomainInfo
+	var errs []error
+	names := make(map[string]string)
+
+	for _, dir := range dirs {
+		id := filepath.Base(dir)
+		name := readSysfsValue(filepath.Join(dir, "name"))
+		if name == "" {
+			name = id
+		}
+		// Named after their package, such as package-0/dram
+		if parent, ok := names[id[:strings.LastIndexByte(id, ':')]]; ok {
+			name = parent + "/" + name
+		}
+		names[id] = name
+
+		energy, err := os.ReadFile(filepath.Join(dir, "energy_uj"))
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				err = fmt.Errorf("%v, the agent needs to run as root to read energy counters since Linux 5.10", err)
+			}
+			errs = append(errs, fmt.Errorf("reading RAPL energy of %s: %v", name, err))
+			continue
+		}
+
+		energyUJ, err := strconv.ParseUint(strings.TrimSpace(string(energy)), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing RAPL energy of %s: %v", name, err))
+			continue
+		}
+
+		current := raplSample{energyUJ: energyUJ, at: time.Now()}
+		domain := apiRAPLDomainInfo{Name: name}
+
+		if previous, ok := c.raplSamples[dir]; ok {
+			var maxEnergyUJ uint64
+			if energyUJ < previous.energyUJ {
+				maxEnergyUJ, _ = strconv.ParseUint(readSysfsValue(filepath.Join(dir, "max_energy_range_uj")), 10, 64)
+			}
+			domain.PowerW, domain.PowerIsAvailable = raplPower(previous, current, maxEnergyUJ, 2*c.interval)
+		}
+
+		c.raplSamples[dir] = current
+		domains = append(domains, domain)
+	}
+
+	return domains, errs
+}
+
+// Returns the average power in watts between two readings of a RAPL energy counter. Not
+// available when the previous reading is older than maxAge, since the section only gets
+// collected while someone asks for it and the average over a long pause says little about
+// the current power, or when the counter wrapped around and its range couldn't be read.
+func raplPower(previous, current raplSample, maxEnergyUJ uint64, maxAge time.Duration) (float64, bool) {
+	elapsed := current.at.Sub(previous.at)
+	if elapsed <= 0 || elapsed > maxAge {
+		return 0, false
+	}
+
+	delta := current.energyUJ - previous.energyUJ
+	// The counter wraps around to 0 after reaching its maximum
+	if current.energyUJ < previous.energyUJ {
+		if maxEnergyUJ < previous.energyUJ {
+			return 0, false
+		}
+		delta = maxEnergyUJ - previous.energyUJ + current.energyUJ
+	}
+
+	return float64(delta) / 1e6 / elapsed.Seconds(), true
+}
+
+func readBatteries() ([]apiBatteryInfo, error) {
+	entries, err := os.ReadDir(powerSupplyDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var batteries []apiBatteryInfo
+
+	for _, entry := range entries {
+		dir := filepath.Join(powerSupplyDir, entry.Name())
+		// Batteries of peripherals such as wireless mice have a scope of Device
+		if readSysfsValue(filepath.Join(dir, "type")) != "Battery" || readSysfsValue(filepath.Join(dir, "scope")) == "Device" {
+			continue
+		}
+
+		batteries = append(batteries, readBattery(dir))
+	}
+
+	return batteries, nil
+}
+
+// See https://docs.kernel.org/power/power_supply_class.html for the meaning of each attribute.
+// Energy is in µWh and power in µW, or with some drivers charge in µAh and current in µA instead.
+func readBattery(dir string) apiBatteryInfo {
+	// Some drivers report the current as negative while discharging
+	value := func(attribute string) (uint64, bool) {
+		v, err := strconv.ParseInt(readSysfsValue(filepath.Join(dir, attribute)), 10, 64)
+		if v < 0 {
+			v = -v
+		}
+		return uint64(v), err == nil
+	}
+
+	battery := apiBatteryInfo{
+		Name:   filepath.Base(dir),
+		Status: strings.ToLower(readSysfsValue(filepath.Join(dir, "status"))),
+	}
+	if battery.Status == "" {
+		battery.Status = "unknown"
+	}
+	battery.Charging = battery.Status == "charging"
+
+	if capacity, ok := value("capacity"); ok {
+		battery.CapacityIsAvailable = true
+		battery.CapacityPercent = uint8(min(capacity, 100))
+	}
+
+	now, hasNow := value("energy_now")
+	full, hasFull := value("energy_full")
+	rate, hasRate := value("power_now")
+	if !hasNow || !hasRate {
+		now, hasNow = value("charge_now")
+		full, hasFull = value("charge_full")
+		rate, hasRate = value("current_now")
+	} else {
+		battery.PowerIsAvailable = true
+		battery.PowerW = float64(rate) / 1e6
+	}
+
+	// Only some drivers report the time directly
+	switch battery.Status {
+	case "discharging":
+		if seconds, ok := value("time_to_empty_now"); ok {
+			battery.TimeRemainingIsAvailable = true
+			battery.TimeRemainingSeconds = seconds
+		} else if hasNow && hasRate && rate > 0 {
+			battery.TimeRemainingIsAvailable = true
+			battery.TimeRemainingSeconds = now * 3600 / rate
+		}
+	case "charging":
+		if seconds, ok := value("time_to_full_now"); ok {
+			battery.TimeRemainingIsAvailable = true
+			battery.TimeRemainingSeconds = seconds
+		} else if hasNow && hasFull && hasRate && rate > 0 && full > now {
+			battery.TimeRemainingIsAvailable = true
+			battery.TimeRemainingSeconds = (full - now) * 3600 / rate
+		}
+	}
+
+	return battery
+}
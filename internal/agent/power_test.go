@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRAPLPower(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name          string
+		previous      raplSample
+		current       raplSample
+		maxEnergyUJ   uint64
+		wantW         float64
+		wantAvailable bool
+	}{
+		{"increasing", raplSample{1_000_000, at(0)}, raplSample{21_000_000, at(2)}, 0, 10, true},
+		{"wrapped", raplSample{262_000_000_000, at(0)}, raplSample{10_000_000, at(2)}, 262_143_328_850, 76.664425, true},
+		{"wrapped with an unreadable range", raplSample{262_000_000_000, at(0)}, raplSample{10_000_000, at(2)}, 0, 0, false},
+		{"previous reading too old", raplSample{1_000_000, at(0)}, raplSample{21_000_000, at(30)}, 0, 0, false},
+		{"no time passed", raplSample{1_000_000, at(2)}, raplSample{1_000_000, at(2)}, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, available := raplPower(test.previous, test.current, test.maxEnergyUJ, 10*time.Second)
+			if available != test.wantAvailable || (available && (w < test.wantW-1e-6 || w > test.wantW+1e-6)) {
+				t.Errorf("got %v W and available %v, want %v W and available %v", w, available, test.wantW, test.wantAvailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPushInterval   = 10 * time.Second
+	defaultPushTimeout    = 10 * time.Second
+	defaultPushBufferSize = 360
+	maxPushBatchSize      = 60
+	maxPushBackoff        = 5 * time.Minute
+)
+
+type pushConfig struct {
+	// Where samples get POSTed to, push mode is disabled when empty
+	URL string `yaml:"url"`
+	// Used to sign each request with HMAC-SHA256 so that the receiver can verify it
+	Secret   string        `yaml:"secret"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// How many samples to keep while the receiver is unreachable, oldest get dropped first
+	BufferSize int `yaml:"buffer-size"`
+	// Sections to include in each sample, all of them when empty
+	Sections []string `yaml:"sections"`
+}
+
+func (c *pushConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("push.url must be an http or https URL, got %q", c.URL)
+	}
+
+	if c.Interval < 0 || c.Timeout < 0 || c.BufferSize < 0 {
+		return errors.New("push.interval, push.timeout and push.buffer-size can't be negative")
+	}
+
+	if err := validateSectionNames(c.Sections); err != nil {
+		return fmt.Errorf("push.sections: %v", err)
+	}
+
+	return nil
+}
+
+type pushSample struct {
+	Timestamp int64          `json:"timestamp"`
+	Sysinfo   *apiSystemInfo `json:"sysinfo"`
+}
+
+type pushPayload struct {
+	AgentID      string       `json:"agent_id"`
+	AgentVersion string       `json:"agent_version"`
+	Samples      []pushSample `json:"samples"`
+}
+
+type pusher struct {
+	url       string
+	secret    []byte
+	sections  []string
+	agentID   string
+	collector *collector
+	client    *http.Client
+	delivery  *bufferedDelivery[pushSample]
+}
+
+func newPusher(config *pushConfig, agentID string, collector *collector) *pusher {
+	p := &pusher{
+		url:       config.URL,
+		secret:    []byte(config.Secret),
+		sections:  config.Sections,
+		agentID:   agentID,
+		collector: collector,
+		client:    &http.Client{Timeout: config.Timeout},
+	}
+
+	if p.client.Timeout == 0 {
+		p.client.Timeout = defaultPushTimeout
+	}
+
+	if len(p.sections) == 0 {
+		p.sections = sectionNames()
+	}
+
+	p.delivery = &bufferedDelivery[pushSample]{
+		interval:        config.Interval,
+		bufferSize:      config.BufferSize,
+		batchSize:       maxPushBatchSize,
+		maxBackoff:      maxPushBackoff,
+		failureMessage:  "Could not push system info",
+		recoveryMessage: "Pushing system info succeeded again",
+		logger:          slog.Default(),
+		sample:          p.sample,
+		deliver:         p.send,
+	}
+
+	if p.delivery.interval == 0 {
+		p.delivery.interval = defaultPushInterval
+	}
+
+	if p.delivery.bufferSize == 0 {
+		p.delivery.bufferSize = defaultPushBufferSize
+	}
+
+	return p
+}
+
+func (p *pusher) run(ctx context.Context) {
+	slog.Info("Pushing system info", "url", p.url, "interval", p.delivery.interval, "agent_id", p.agentID)
+	p.delivery.run(ctx)
+}
+
+func (p *pusher) sample() pushSample {
+	info, collectedAt := p.collector.get(p.sections)
+	return pushSample{Timestamp: collectedAt.Unix(), Sysinfo: info}
+}
+
+func (p *pusher) send(ctx context.Context, samples []pushSample) error {
+	body, err := json.Marshal(pushPayload{
+		AgentID:      p.agentID,
+		AgentVersion: buildVersion,
+		Samples:      samples,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "luna-agent/"+buildVersion)
+	req.Header.Set("X-Luna-Agent-Id", p.agentID)
+	req.Header.Set("X-Luna-Timestamp", timestamp)
+	if len(p.secret) > 0 {
+		req.Header.Set("X-Luna-Signature", "sha256="+signPushRequest(p.secret, timestamp, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// The timestamp is included in the signature so that receivers
+// can reject old requests that are being replayed by someone else
+func signPushRequest(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
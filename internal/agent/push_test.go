@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignPushRequest(t *testing.T) {
+	// Computed independently with Python's hmac module
+	want := "89196c7bde47af8b17929aec6646d80a611284a7cdfd969f843bb60c00d6acf0"
+	if got := signPushRequest([]byte("secret"), "1760000000", []byte(`{"agent_id":"a"}`)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// What a receiver sees of each request
+type pushAttempt struct {
+	at      time.Time
+	status  int
+	payload pushPayload
+}
+
+// Verifies requests the way the README tells receivers to, rejecting those with a bad
+// signature or a timestamp outside of the replay window, and fails the first few with a 503
+func newPushReceiver(t *testing.T, secret string, failures int) (*httptest.Server, func() []pushAttempt) {
+	const replayWindow = 5 * time.Minute
+
+	var mu sync.Mutex
+	var attempts []pushAttempt
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		attempt := pushAttempt{at: time.Now(), status: http.StatusOK}
+		if err := json.Unmarshal(body, &attempt.payload); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+
+		timestamp := r.Header.Get("X-Luna-Timestamp")
+		sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sentAt, 0)).Abs() > replayWindow {
+			t.Errorf("timestamp %q is outside of the replay window", timestamp)
+			attempt.status = http.StatusUnauthorized
+		}
+
+		expected := "sha256=" + signPushRequest([]byte(secret), timestamp, body)
+		if !hmac.Equal([]byte(r.Header.Get("X-Luna-Signature")), []byte(expected)) {
+			t.Errorf("invalid signature %q", r.Header.Get("X-Luna-Signature"))
+			attempt.status = http.StatusUnauthorized
+		}
+
+		if r.Header.Get("X-Luna-Agent-Id") != attempt.payload.AgentID {
+			t.Errorf("agent ID header %q doesn't match the body", r.Header.Get("X-Luna-Agent-Id"))
+		}
+
+		mu.Lock()
+		if attempt.status == http.StatusOK && len(attempts) < failures {
+			attempt.status = http.StatusServiceUnavailable
+		}
+		attempts = append(attempts, attempt)
+		mu.Unlock()
+
+		w.WriteHeader(attempt.status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []pushAttempt {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pushAttempt(nil), attempts...)
+	}
+}
+
+func TestPusherRetriesWithBackoff(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	const failures = 3
+
+	server, attempts := newPushReceiver(t, "secret", failures)
+
+	collector := newCollector(&systemConfig{Interval: interval})
+	p := newPusher(&pushConfig{
+		URL:      server.URL,
+		Secret:   "secret",
+		Interval: interval,
+		Sections: []string{sectionMemory},
+	}, "test-agent", collector)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(attempts()) <= failures && time.Now().Before(deadline) {
+		time.Sleep(interval)
+	}
+	cancel()
+	<-done
+
+	got := attempts()
+	if len(got) <= failures {
+		t.Fatalf("expected a successful attempt after %d failures, got %d attempts", failures, len(got))
+	}
+
+	// The backoff starts at the interval and doubles after each failure
+	for i := 1; i <= failures; i++ {
+		minGap := interval << (i - 1)
+		if gap := got[i].at.Sub(got[i-1].at); gap < minGap {
+			t.Errorf("attempt %d came %v after the previous one, expected at least %v", i+1, gap, minGap)
+		}
+	}
+
+	// Samples taken while the receiver was failing are kept and sent along with later ones
+	for i := 1; i < len(got); i++ {
+		if len(got[i].payload.Samples) <= len(got[i-1].payload.Samples) && got[i-1].status != http.StatusOK {
+			t.Errorf("attempt %d sent %d samples after attempt %d sent %d and failed",
+				i+1, len(got[i].payload.Samples), i, len(got[i-1].payload.Samples))
+		}
+	}
+
+	success := got[failures]
+	if success.status != http.StatusOK {
+		t.Fatalf("expected attempt %d to succeed, got status %d", failures+1, success.status)
+	}
+	if success.payload.AgentID != "test-agent" {
+		t.Errorf("got agent ID %q", success.payload.AgentID)
+	}
+	for _, sample := range success.payload.Samples {
+		if sample.Sysinfo == nil || sample.Sysinfo.Memory == nil || sample.Sysinfo.CPU != nil {
+			t.Errorf("expected samples to only have the memory section, got %+v", sample.Sysinfo)
+		}
+	}
+
+	if len(p.delivery.buffer) != 0 {
+		t.Errorf("expected the buffer to be empty after a successful push, got %d samples", len(p.delivery.buffer))
+	}
+}
@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	mdstatPath    = "/proc/mdstat"
+	mdSysfsDir    = "/sys/block"
+	btrfsSysfsDir = "/sys/fs/btrfs"
+)
+
+const (
+	raidTypeMD    = "md"
+	raidTypeBtrfs = "btrfs"
+)
+
+func (c *collector) collectRAID(info *apiSystemInfo) []error {
+	var errs []error
+	info.RAID = []apiRAIDArrayInfo{}
+
+	mdstat, err := os.ReadFile(mdstatPath)
+	if err == nil {
+		info.RAID = append(info.RAID, parseMdstat(mdstat)...)
+	} else if !os.IsNotExist(err) {
+		errs = append(errs, fmt.Errorf("reading %s: %v", mdstatPath, err))
+	}
+
+	for i := range info.RAID {
+		readMDDeviceErrors(&info.RAID[i])
+	}
+
+	arrays, err := readBtrfsArrays()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading Btrfs filesystems: %v", err))
+	}
+	info.RAID = append(info.RAID, arrays...)
+
+	return errs
+}
+
+var (
+	mdstatArrayPattern    = regexp.MustCompile(`^(md\w*) : (\w+) (.*)$`)
+	mdstatDevicePattern   = regexp.MustCompile(`^(.+)\[\d+\]((?:\([A-Z]\))*)$`)
+	mdstatCountsPattern   = regexp.MustCompile(`\[(\d+)/(\d+)\]`)
+	mdstatProgressPattern = regexp.MustCompile(`(resync|recovery|check|reshape|repair)\s*=\s*([\d.]+)%`)
+	mdstatPendingPattern  = regexp.MustCompile(`(resync|recovery|check|reshape|repair)\s*=\s*(?:DELAYED|PENDING)`)
+)
+
+// Parses the contents of /proc/mdstat, which for each array looks like:
+//
+//	md1 : active raid1 sdd1[2](F) sdc1[0]
+//	      976630464 blocks super 1.2 [2/1] [U_]
+//	      [==>..................]  recovery = 12.6% (123456/976630464) finish=100.0min speed=100000K/sec
+func parseMdstat(mdstat []byte) []apiRAIDArrayInfo {
+	var arrays []apiRAIDArrayInfo
+	var array *apiRAIDArrayInfo
+
+	scanner := bufio.NewScanner(bytes.NewReader(mdstat))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := mdstatArrayPattern.FindStringSubmatch(line); match != nil {
+			arrays = append(arrays, apiRAIDArrayInfo{
+				Name:    match[1],
+				Type:    raidTypeMD,
+				Active:  match[2] == "active",
+				Devices: []apiRAIDDeviceInfo{},
+			})
+			array = &arrays[len(arrays)-1]
+
+			for _, field := range strings.Fields(match[3]) {
+				// Such as (auto-read-only) or (read-only) after active
+				if strings.HasPrefix(field, "(") {
+					continue
+				}
+
+				device := mdstatDevicePattern.FindStringSubmatch(field)
+				if device == nil {
+					// Inactive arrays don't list their level
+					if array.Level == "" && array.Active {
+						array.Level = field
+					}
+					continue
+				}
+
+				state := "active"
+				switch {
+				case strings.Contains(device[2], "(F)"):
+					state = "faulty"
+				case strings.Contains(device[2], "(S)"):
+					state = "spare"
+				}
+				array.Devices = append(array.Devices, apiRAIDDeviceInfo{Name: device[1], State: state})
+			}
+			continue
+		}
+
+		if array == nil {
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			array = nil
+			continue
+		}
+
+		if match := mdstatCountsPattern.FindStringSubmatch(line); match != nil && array.DevicesTotal == 0 {
+			array.DevicesTotal, _ = strconv.Atoi(match[1])
+			array.DevicesActive, _ = strconv.Atoi(match[2])
+			array.Degraded = array.DevicesActive < array.DevicesTotal
+		}
+
+		if match := mdstatProgressPattern.FindStringSubmatch(line); match != nil {
+			array.SyncAction = match[1]
+			progress, _ := strconv.ParseFloat(match[2], 64)
+			array.SyncProgressPercent = uint8(min(progress, 100))
+		} else if match := mdstatPendingPattern.FindStringSubmatch(line); match != nil {
+			array.SyncAction = match[1]
+		}
+	}
+
+	return arrays
+}
+
+// Reads the number of read errors that were corrected for each member of an md array
+func readMDDeviceErrors(array *apiRAIDArrayInfo) {
+	for i := range array.Devices {
+		device := &array.Devices[i]
+		count, err := os.ReadFile(filepath.Join(mdSysfsDir, array.Name, "md", "dev-"+device.Name, "errors"))
+		if err == nil {
+			device.ReadErrors, _ = strconv.ParseUint(strings.TrimSpace(string(count)), 10, 64)
+		}
+	}
+}
+
+// Returns Btrfs filesystems that span multiple devices, each of which
+// is a directory named after its UUID in /sys/fs/btrfs
+func readBtrfsArrays() ([]apiRAIDArrayInfo, error) {
+	entries, err := os.ReadDir(btrfsSysfsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var arrays []apiRAIDArrayInfo
+	for _, entry := range entries {
+		dir := filepath.Join(btrfsSysfsDir, entry.Name())
+
+		devids, err := os.ReadDir(filepath.Join(dir, "devinfo"))
+		// Also excludes directories that aren't filesystems, such as features
+		if err != nil || len(devids) < 2 {
+			continue
+		}
+
+		array := apiRAIDArrayInfo{
+			Name:    readSysfsValue(filepath.Join(dir, "label")),
+			Type:    raidTypeBtrfs,
+			Level:   btrfsDataProfile(dir),
+			Active:  true,
+			Devices: []apiRAIDDeviceInfo{},
+		}
+
+		if array.Name == "" {
+			array.Name = entry.Name()
+		}
+
+		switch operation := readSysfsValue(filepath.Join(dir, "exclusive_operation")); operation {
+		case "balance", "device replace":
+			array.SyncAction = strings.TrimPrefix(operation, "device ")
+		}
+
+		for _, devid := range devids {
+			array.Devices = append(array.Devices, readBtrfsDevice(filepath.Join(dir, "devinfo", devid.Name())))
+		}
+
+		slices.SortFunc(array.Devices, func(a, b apiRAIDDeviceInfo) int {
+			x, _ := strconv.Atoi(a.Name)
+			y, _ := strconv.Atoi(b.Name)
+			return x - y
+		})
+
+		array.DevicesTotal = len(array.Devices)
+		for i := range array.Devices {
+			if array.Devices[i].State == "active" {
+				array.DevicesActive++
+			}
+		}
+		array.Degraded = array.DevicesActive < array.DevicesTotal
+
+		arrays = append(arrays, array)
+	}
+
+	return arrays, nil
+}
+
+// The kernel doesn't expose which block device a devid belongs to, so devices are named after their devid
+func readBtrfsDevice(dir string) apiRAIDDeviceInfo {
+	device := apiRAIDDeviceInfo{Name: filepath.Base(dir), State: "active"}
+
+	if readSysfsValue(filepath.Join(dir, "missing")) == "1" {
+		device.State = "missing"
+	}
+
+	// Only exists since Linux 5.14
+	stats, err := os.ReadFile(filepath.Join(dir, "error_stats"))
+	if err != nil {
+		return device
+	}
+
+	for line := range strings.Lines(string(stats)) {
+		name, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		n, _ := strconv.ParseUint(value, 10, 64)
+
+		switch name {
+		case "read_errs":
+			device.ReadErrors = n
+		case "write_errs":
+			device.WriteErrors = n
+		case "flush_errs":
+			device.FlushErrors = n
+		case "corruption_errs":
+			device.CorruptionErrors = n
+		case "generation_errs":
+			device.GenerationErrors = n
+		}
+	}
+
+	return device
+}
+
+// Returns the profile used for data, which the kernel exposes as a directory such as
+// allocation/data/raid1, with there being more than one while converting between them
+func btrfsDataProfile(dir string) string {
+	entries, err := os.ReadDir(filepath.Join(dir, "allocation", "data"))
+	if err != nil {
+		return ""
+	}
+
+	var profiles []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+
+	return strings.Join(profiles, ",")
+}
+
+func readSysfsValue(path string) string {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(value))
+}
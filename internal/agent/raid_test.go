@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMdstat(t *testing.T) {
+	tests := []struct {
+		file string
+		want []apiRAIDArrayInfo
+	}{
+		{
+			// Spares and faulty devices count toward neither the total nor the active devices
+			file: "degraded.txt",
+			want: []apiRAIDArrayInfo{
+				{
+					Name: "md0", Type: raidTypeMD, Level: "raid1", Active: true, Degraded: true,
+					DevicesTotal: 2, DevicesActive: 1,
+					Devices: []apiRAIDDeviceInfo{{Name: "sdb1", State: "faulty"}, {Name: "sda1", State: "active"}},
+				},
+				{
+					Name: "md1", Type: raidTypeMD, Level: "raid1", Active: true,
+					DevicesTotal: 2, DevicesActive: 2,
+					Devices: []apiRAIDDeviceInfo{{Name: "sdd1", State: "spare"}, {Name: "sdc1", State: "active"}, {Name: "sde1", State: "active"}},
+				},
+			},
+		},
+		{
+			// The progress line has a count of blocks in parentheses, which mustn't be taken for the device counts
+			file: "recovery.txt",
+			want: []apiRAIDArrayInfo{
+				{
+					Name: "md127", Type: raidTypeMD, Level: "raid5", Active: true, Degraded: true,
+					DevicesTotal: 4, DevicesActive: 3, SyncAction: "recovery", SyncProgressPercent: 38,
+					Devices: []apiRAIDDeviceInfo{
+						{Name: "sde", State: "active"}, {Name: "sdd", State: "active"},
+						{Name: "sdc", State: "active"}, {Name: "sdb", State: "active"},
+					},
+				},
+			},
+		},
+		{
+			// Arrays sharing disks wait for each other to finish syncing
+			file: "delayed.txt",
+			want: []apiRAIDArrayInfo{
+				{
+					Name: "md1", Type: raidTypeMD, Level: "raid1", Active: true,
+					DevicesTotal: 2, DevicesActive: 2, SyncAction: "resync", SyncProgressPercent: 12,
+					Devices: []apiRAIDDeviceInfo{{Name: "sdb2", State: "active"}, {Name: "sda2", State: "active"}},
+				},
+				{
+					Name: "md0", Type: raidTypeMD, Level: "raid1", Active: true,
+					DevicesTotal: 2, DevicesActive: 2, SyncAction: "resync",
+					Devices: []apiRAIDDeviceInfo{{Name: "sdb1", State: "active"}, {Name: "sda1", State: "active"}},
+				},
+			},
+		},
+		{
+			file: "auto-read-only.txt",
+			want: []apiRAIDArrayInfo{
+				{
+					Name: "md2", Type: raidTypeMD, Level: "raid1", Active: true,
+					DevicesTotal: 2, DevicesActive: 2, SyncAction: "resync",
+					Devices: []apiRAIDDeviceInfo{{Name: "sdd1", State: "active"}, {Name: "sdc1", State: "active"}},
+				},
+			},
+		},
+		{
+			// Assembled at boot without enough devices to start, so the level isn't known
+			file: "inactive.txt",
+			want: []apiRAIDArrayInfo{
+				{
+					Name: "md126", Type: raidTypeMD,
+					Devices: []apiRAIDDeviceInfo{
+						{Name: "sdc", State: "spare"}, {Name: "sdb", State: "spare"}, {Name: "sda", State: "spare"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			mdstat, err := os.ReadFile(filepath.Join("testdata", "mdstat", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := parseMdstat(mdstat)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d arrays, want %d: %+v", len(got), len(test.want), got)
+			}
+
+			for i := range test.want {
+				if !reflect.DeepEqual(got[i], test.want[i]) {
+					t.Errorf("array %s:\ngot  %+v\nwant %+v", test.want[i].Name, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
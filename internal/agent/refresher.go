@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// Refreshes the result of a slow function, such as one running external commands, in its own
+// goroutine on its own schedule, so that collecting the section it belongs to only copies the
+// latest result and never holds up other sections, requests or the watchdog
+type refresher[T any] struct {
+	interval time.Duration
+	// Gets passed the result of the previous refresh, which is the zero value the first time
+	refresh func(previous T) (T, []error)
+
+	start sync.Once
+	wake  chan struct{}
+
+	mu            sync.Mutex
+	value         T
+	errs          []error
+	lastRequested time.Time
+}
+
+func newRefresher[T any](interval time.Duration, refresh func(previous T) (T, []error)) *refresher[T] {
+	return &refresher[T]{
+		interval: interval,
+		refresh:  refresh,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Returns the result of the latest refresh, which is the zero value until the first one
+// completes. Refreshing starts on the first call and pauses while nobody calls it.
+func (r *refresher[T]) get() (T, []error) {
+	r.start.Do(func() { go r.run() })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.isIdle() {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+	r.lastRequested = time.Now()
+
+	return r.value, r.errs
+}
+
+// Must be called with mu held
+func (r *refresher[T]) isIdle() bool {
+	return time.Since(r.lastRequested) > sectionIdleTimeout
+}
+
+func (r *refresher[T]) run() {
+	var previous T
+	var refreshedAt time.Time
+
+	for {
+		if wait := r.interval - time.Since(refreshedAt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		r.mu.Lock()
+		idle := r.isIdle()
+		r.mu.Unlock()
+		if idle {
+			<-r.wake
+			continue
+		}
+
+		value, errs := r.refresh(previous)
+		previous = value
+		refreshedAt = time.Now()
+
+		r.mu.Lock()
+		r.value, r.errs = value, errs
+		r.mu.Unlock()
+	}
+}
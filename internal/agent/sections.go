@@ -0,0 +1,500 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/luna-page/luna/pkg/sysinfo"
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/shirou/gopsutil/v4/host"
+	"github.com/shirou/gopsutil/v4/load"
+	"github.com/shirou/gopsutil/v4/mem"
+	"github.com/shirou/gopsutil/v4/sensors"
+)
+
+const (
+	sectionHost        = "host"
+	sectionCPU         = "cpu"
+	sectionMemory      = "memory"
+	sectionMountpoints = "mountpoints"
+	sectionZFS         = "zfs"
+	sectionRAID        = "raid"
+	sectionSMART       = "smart"
+	sectionSensors     = "sensors"
+	sectionPower       = "power"
+	sectionUPS         = "ups"
+)
+
+// A part of the system info that gets collected independently so that the
+// collector can skip the work for sections that nobody has asked for recently
+type section struct {
+	name string
+	// Collects the section into info, which is otherwise empty
+	collect func(c *collector, info *apiSystemInfo) []error
+	// Copies the section's value from src to dst
+	copy func(dst, src *apiSystemInfo)
+	// Returns the section's value by itself, used for the per-section endpoints
+	value func(info *apiSystemInfo) any
+	// A value of the section's type, used to generate the OpenAPI document
+	schema any
+}
+
+var sections = []section{
+	{
+		name:    sectionHost,
+		collect: (*collector).collectHost,
+		copy:    func(dst, src *apiSystemInfo) { dst.apiHostInfo = src.apiHostInfo },
+		value:   func(info *apiSystemInfo) any { return info.apiHostInfo },
+		schema:  apiHostInfo{},
+	},
+	{
+		name:    sectionCPU,
+		collect: (*collector).collectCPU,
+		copy:    func(dst, src *apiSystemInfo) { dst.CPU = src.CPU },
+		value:   func(info *apiSystemInfo) any { return info.CPU },
+		schema:  apiCPUInfo{},
+	},
+	{
+		name:    sectionMemory,
+		collect: (*collector).collectMemory,
+		copy:    func(dst, src *apiSystemInfo) { dst.Memory = src.Memory },
+		value:   func(info *apiSystemInfo) any { return info.Memory },
+		schema:  apiMemoryInfo{},
+	},
+	{
+		name:    sectionMountpoints,
+		collect: (*collector).collectMountpoints,
+		copy:    func(dst, src *apiSystemInfo) { dst.Mountpoints = src.Mountpoints },
+		value:   func(info *apiSystemInfo) any { return info.Mountpoints },
+		schema:  []apiMountpointInfo{},
+	},
+	{
+		name:    sectionZFS,
+		collect: (*collector).collectZFS,
+		copy:    func(dst, src *apiSystemInfo) { dst.ZFS = src.ZFS },
+		value:   func(info *apiSystemInfo) any { return info.ZFS },
+		schema:  []apiZFSPoolInfo{},
+	},
+	{
+		name:    sectionRAID,
+		collect: (*collector).collectRAID,
+		copy:    func(dst, src *apiSystemInfo) { dst.RAID = src.RAID },
+		value:   func(info *apiSystemInfo) any { return info.RAID },
+		schema:  []apiRAIDArrayInfo{},
+	},
+	{
+		name:    sectionSMART,
+		collect: (*collector).collectSMART,
+		copy:    func(dst, src *apiSystemInfo) { dst.SMART = src.SMART },
+		value:   func(info *apiSystemInfo) any { return info.SMART },
+		schema:  []apiSMARTDeviceInfo{},
+	},
+	{
+		name:    sectionSensors,
+		collect: (*collector).collectSensors,
+		copy:    func(dst, src *apiSystemInfo) { dst.Sensors = src.Sensors },
+		value:   func(info *apiSystemInfo) any { return info.Sensors },
+		schema:  []apiSensorInfo{},
+	},
+	{
+		name:    sectionPower,
+		collect: (*collector).collectPower,
+		copy:    func(dst, src *apiSystemInfo) { dst.Power = src.Power },
+		value:   func(info *apiSystemInfo) any { return info.Power },
+		schema:  apiPowerInfo{},
+	},
+	{
+		name:    sectionUPS,
+		collect: (*collector).collectUPS,
+		copy:    func(dst, src *apiSystemInfo) { dst.UPS = src.UPS },
+		value:   func(info *apiSystemInfo) any { return info.UPS },
+		schema:  []apiUPSInfo{},
+	},
+}
+
+func sectionNames() []string {
+	names := make([]string, len(sections))
+	for i := range sections {
+		names[i] = sections[i].name
+	}
+
+	return names
+}
+
+func findSection(name string) *section {
+	for i := range sections {
+		if sections[i].name == name {
+			return &sections[i]
+		}
+	}
+
+	return nil
+}
+
+// Parses a comma separated list of section names, returning false if any of them is unknown
+func parseSectionNames(fields string) ([]string, bool) {
+	var names []string
+	for name := range strings.SplitSeq(fields, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if findSection(name) == nil {
+			return nil, false
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, true
+}
+
+// Checks the sections option of push, MQTT and outputs, which limits the sections
+// they collect to keep the others from being collected in the background
+func validateSectionNames(names []string) error {
+	for _, name := range names {
+		if findSection(name) == nil {
+			return fmt.Errorf("unknown section %q, expected one of: %s", name, strings.Join(sectionNames(), ", "))
+		}
+	}
+
+	return nil
+}
+
+// Caches host info indefinitely once it has been retrieved successfully, which isn't ideal
+// for the hostname. Potential issue with caching boot time as it may not initially get
+// reported correctly: https://github.com/shirou/gopsutil/issues/842#issuecomment-1908972344
+func (c *collector) collectHost(info *apiSystemInfo) []error {
+	if c.hostInfo != nil {
+		info.apiHostInfo = c.hostInfo
+		return nil
+	}
+
+	info.apiHostInfo = &apiHostInfo{}
+	fail := func(err error) []error {
+		return []error{fmt.Errorf("getting host info: %v", err)}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fail(err)
+	}
+
+	platform, _, _, err := host.PlatformInformation()
+	if err != nil {
+		return fail(err)
+	}
+
+	bootTime, err := host.BootTime()
+	if err != nil {
+		return fail(err)
+	}
+
+	c.hostInfo = &apiHostInfo{
+		HostInfoIsAvailable: true,
+		BootTime:            int64(bootTime),
+		Hostname:            hostname,
+		Platform:            platform,
+	}
+	info.apiHostInfo = c.hostInfo
+
+	return nil
+}
+
+func (c *collector) collectCPU(info *apiSystemInfo) []error {
+	var errs []error
+	info.CPU = &apiCPUInfo{}
+
+	coreCount, err := cpu.Counts(true)
+	if err == nil {
+		loadAvg, err := load.Avg()
+		if err == nil {
+			info.CPU.LoadIsAvailable = true
+			if runtime.GOOS == "windows" {
+				// The numbers returned here seem unreliable on Windows. Even with the CPU pegged
+				// at close to 50% for multiple minutes, load1 is sometimes way under or way over
+				// with no clear pattern. Dividing by core count gives numbers that are way too
+				// low so that's likely not necessary as it is with unix.
+				info.CPU.Load1Percent = uint8(math.Min(loadAvg.Load1*100, 100))
+				info.CPU.Load15Percent = uint8(math.Min(loadAvg.Load15*100, 100))
+			} else {
+				info.CPU.Load1Percent = uint8(math.Min((loadAvg.Load1/float64(coreCount))*100, 100))
+				info.CPU.Load15Percent = uint8(math.Min((loadAvg.Load15/float64(coreCount))*100, 100))
+			}
+		} else {
+			errs = append(errs, fmt.Errorf("getting load avg: %v", err))
+		}
+	} else {
+		errs = append(errs, fmt.Errorf("getting core count: %v", err))
+	}
+
+	// Measured since the previous call, which is the previous time this section got collected
+	if percent, err := cpu.Percent(0, false); err == nil && len(percent) == 1 {
+		info.CPU.UtilizationIsAvailable = true
+		info.CPU.UtilizationPercent = uint8(math.Round(percent[0]))
+	} else if err != nil {
+		errs = append(errs, fmt.Errorf("getting CPU utilization: %v", err))
+	}
+
+	// Disabled on Windows because it requires elevated privileges, otherwise it keeps
+	// returning a single sensor with key "ACPI\\ThermalZone\\TZ00_0" which doesn't seem
+	// to be the CPU sensor or correspond to anything useful when compared against the
+	// temperatures Libre Hardware Monitor reports. Also not implemented by gopsutil for the bsd's.
+	if runtime.GOOS == "windows" || runtime.GOOS == "openbsd" || runtime.GOOS == "netbsd" || runtime.GOOS == "freebsd" {
+		return errs
+	}
+
+	sensorReadings, err := sensors.SensorsTemperatures()
+	if _, isWarning := err.(*sensors.Warnings); err != nil && !isWarning {
+		return append(errs, fmt.Errorf("getting sensor readings: %v", err))
+	}
+
+	if c.request.CPUTempSensor != "" {
+		for i := range sensorReadings {
+			if sensorReadings[i].SensorKey == c.request.CPUTempSensor {
+				info.CPU.TemperatureIsAvailable = true
+				info.CPU.TemperatureC = uint8(sensorReadings[i].Temperature)
+				info.CPU.TemperatureSensor = sensorReadings[i].SensorKey
+				break
+			}
+		}
+
+		if !info.CPU.TemperatureIsAvailable {
+			errs = append(errs, fmt.Errorf("CPU temperature sensor %s not found", c.request.CPUTempSensor))
+		}
+	} else if cpuTempSensor := inferCPUTempSensor(sensorReadings); cpuTempSensor != nil {
+		info.CPU.TemperatureIsAvailable = true
+		info.CPU.TemperatureC = uint8(cpuTempSensor.Temperature)
+		info.CPU.TemperatureSensor = cpuTempSensor.SensorKey
+	}
+
+	return errs
+}
+
+func (c *collector) collectMemory(info *apiSystemInfo) []error {
+	var errs []error
+	info.Memory = &apiMemoryInfo{}
+
+	memory, err := mem.VirtualMemory()
+	if err == nil {
+		info.Memory.IsAvailable = true
+		info.Memory.TotalMB = memory.Total / 1024 / 1024
+		info.Memory.UsedMB = memory.Used / 1024 / 1024
+		info.Memory.UsedPercent = uint8(math.Min(memory.UsedPercent, 100))
+	} else {
+		errs = append(errs, fmt.Errorf("getting memory info: %v", err))
+	}
+
+	swapMemory, err := mem.SwapMemory()
+	if err == nil {
+		info.Memory.SwapIsAvailable = true
+		info.Memory.SwapTotalMB = swapMemory.Total / 1024 / 1024
+		info.Memory.SwapUsedMB = swapMemory.Used / 1024 / 1024
+		info.Memory.SwapUsedPercent = uint8(math.Min(swapMemory.UsedPercent, 100))
+	} else {
+		errs = append(errs, fmt.Errorf("getting swap memory info: %v", err))
+	}
+
+	return errs
+}
+
+func (c *collector) collectMountpoints(info *apiSystemInfo) []error {
+	var errs []error
+	req := c.request
+	info.Mountpoints = []apiMountpointInfo{}
+
+	findRequest := func(fs *disk.PartitionStat) sysinfo.MointpointRequest {
+		if rule := c.config.findMountpointRule(fs.Mountpoint, fs.Fstype); rule != nil {
+			return rule.request
+		}
+		return sysinfo.MointpointRequest{}
+	}
+
+	filesystems, err := disk.Partitions(false)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("getting filesystems: %v", err))
+	}
+
+	// Includes virtual and network filesystems, which are needed to tell
+	// what the paths from the config are on even when they aren't listed
+	all, err := disk.Partitions(true)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("getting all filesystems: %v", err))
+	}
+
+	// Virtual and network filesystems such as tmpfs or nfs are left out unless a rule for their type shows them
+	for i := range all {
+		rule := c.config.findMountpointRule(all[i].Mountpoint, all[i].Fstype)
+		if rule != nil && rule.fsType != "" && !slices.ContainsFunc(filesystems, func(fs disk.PartitionStat) bool {
+			return fs.Mountpoint == all[i].Mountpoint
+		}) {
+			filesystems = append(filesystems, all[i])
+		}
+	}
+
+	// The pool of each mounted dataset and the mountpoint that represents each pool
+	var zfsDatasetPools, zfsPoolMountpoints map[string]string
+	var zfsUsages map[string]zfsPoolUsage
+	if c.config.ZFS.CollapseDatasets {
+		zfsDatasetPools, zfsPoolMountpoints = zfsMountpoints(filesystems)
+		if len(zfsPoolMountpoints) > 0 {
+			var usageErrs []error
+			zfsUsages, usageErrs = c.zfsUsages.get()
+			errs = append(errs, usageErrs...)
+		}
+	}
+
+	addedMountpoints := map[string]struct{}{}
+	addMountpointInfo := func(requestedPath string, mpReq sysinfo.MointpointRequest) {
+		if _, exists := addedMountpoints[requestedPath]; exists {
+			return
+		}
+
+		isHidden := req.HideMountpointsByDefault
+		if mpReq.Hide != nil {
+			isHidden = *mpReq.Hide
+		}
+		if isHidden {
+			return
+		}
+
+		path := requestedPath
+		pool, isZFS := zfsDatasetPools[requestedPath]
+		if isZFS {
+			path = zfsPoolMountpoints[pool]
+			if _, exists := addedMountpoints[path]; exists {
+				return
+			}
+			if rule := c.config.findMountpointRule(path, "zfs"); rule != nil && rule.request.Name != "" {
+				mpReq.Name = rule.request.Name
+			}
+		}
+
+		mp := apiMountpointInfo{Path: path, Name: mpReq.Name}
+		if fs := findFilesystem(all, path); fs != nil {
+			mp.FSType = fs.Fstype
+			mp.Device = fs.Device
+			mp.ReadOnly = slices.Contains(fs.Opts, "ro")
+			mp.Network = isNetworkFilesystem(fs.Fstype)
+		}
+
+		var usage *disk.UsageStat
+		var err error
+		if needsUsageProbe(mp.FSType) {
+			usage, mp.Stale, err = c.probeMountUsage(path, mp.FSType)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("getting filesystem usage for %s: %v", path, err))
+				err = nil
+			}
+		} else {
+			usage, err = disk.Usage(path)
+		}
+
+		if usage != nil {
+			mp.TotalMB = usage.Total / 1024 / 1024
+			mp.UsedMB = usage.Used / 1024 / 1024
+			mp.UsedPercent = uint8(math.Min(usage.UsedPercent, 100))
+			mp.InodesTotal = usage.InodesTotal
+			mp.InodesUsed = usage.InodesUsed
+			mp.InodesUsedPercent = uint8(math.Min(usage.InodesUsedPercent, 100))
+			if mp.FSType == "" {
+				mp.FSType = usage.Fstype
+			}
+		}
+
+		if zfsUsage, ok := zfsUsages[pool]; isZFS && ok {
+			total := zfsUsage.usedBytes + zfsUsage.availableBytes
+			mp.TotalMB = total / bytesPerMB
+			mp.UsedMB = zfsUsage.usedBytes / bytesPerMB
+			if total > 0 {
+				mp.UsedPercent = uint8(min(zfsUsage.usedBytes*100/total, 100))
+			}
+			mp.Device = pool
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("getting filesystem usage for %s: %v", path, err))
+			return
+		}
+
+		info.Mountpoints = append(info.Mountpoints, mp)
+		addedMountpoints[path] = struct{}{}
+	}
+
+	for i := range filesystems {
+		addMountpointInfo(filesystems[i].Mountpoint, findRequest(&filesystems[i]))
+	}
+
+	// Paths from the config don't have to be mountpoints themselves
+	for i := range c.config.mountpointRules {
+		if rule := &c.config.mountpointRules[i]; rule.path != "" {
+			addMountpointInfo(rule.path, rule.request)
+		}
+	}
+
+	sort.Slice(info.Mountpoints, func(a, b int) bool {
+		return info.Mountpoints[a].UsedPercent > info.Mountpoints[b].UsedPercent
+	})
+
+	return errs
+}
+
+// Returns the filesystem that a path is on, which is the one with the longest mountpoint containing
+// it, preferring the last one listed since that is the one on top when several are mounted over each other
+func findFilesystem(filesystems []disk.PartitionStat, path string) *disk.PartitionStat {
+	var found *disk.PartitionStat
+	for i := range filesystems {
+		fs := &filesystems[i]
+		if !isPathWithin(path, fs.Mountpoint) {
+			continue
+		}
+		if found == nil || len(fs.Mountpoint) >= len(found.Mountpoint) {
+			found = fs
+		}
+	}
+
+	return found
+}
+
+func isPathWithin(path, dir string) bool {
+	if dir == "/" || path == dir {
+		return true
+	}
+
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// Maps the mountpoint of each ZFS dataset to the name of its pool, along with the mountpoint
+// that represents each pool, which is that of its root dataset or otherwise the shortest one
+func zfsMountpoints(filesystems []disk.PartitionStat) (datasetPools, poolMountpoints map[string]string) {
+	datasetPools = map[string]string{}
+	poolMountpoints = map[string]string{}
+	isRootMounted := map[string]bool{}
+
+	for _, fs := range filesystems {
+		if fs.Fstype != "zfs" {
+			continue
+		}
+
+		pool, _, _ := strings.Cut(fs.Device, "/")
+		datasetPools[fs.Mountpoint] = pool
+
+		if isRootMounted[pool] {
+			continue
+		}
+
+		if fs.Device == pool {
+			isRootMounted[pool] = true
+			poolMountpoints[pool] = fs.Mountpoint
+		} else if current, ok := poolMountpoints[pool]; !ok || len(fs.Mountpoint) < len(current) {
+			poolMountpoints[pool] = fs.Mountpoint
+		}
+	}
+
+	return datasetPools, poolMountpoints
+}
@@ -1,85 +1,321 @@
 package agent
 
 import (
+	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/luna-page/luna/pkg/sysinfo"
+	"github.com/luna-page/agent/internal/systemd"
 )
 
-var cachedSystemInfo struct {
-	json       []byte
-	mu         sync.Mutex
-	lastUpdate time.Time
+const (
+	endpointGroupSysinfo = "sysinfo"
+	endpointGroupHealthz = "healthz"
+	endpointGroupMetrics = "metrics"
+	endpointGroupFleet   = "fleet"
+)
+
+var endpointGroups = []string{
+	endpointGroupSysinfo,
+	endpointGroupHealthz,
+	endpointGroupMetrics,
+	endpointGroupFleet,
+}
+
+type endpoint struct {
+	pattern string
+	handler http.HandlerFunc
 }
 
 func serve(config *config) error {
-	authorizationValue := []byte("Bearer " + config.Server.Token)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	isAuthorized := func(r *http.Request, w http.ResponseWriter) bool {
-		if config.Server.Token != "" &&
-			subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), authorizationValue) != 1 {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return false
-		}
+	collector := newCollector(&config.System)
+	// Collect everything up front so that there's something to serve as soon as we start listening
+	collector.get(sectionNames())
+	go collector.run(ctx)
 
-		return true
+	if config.Push.URL != "" {
+		go newPusher(&config.Push, agentID(config.path), collector).run(ctx)
 	}
 
-	mux := http.NewServeMux()
+	for i := range config.Outputs {
+		go newMetricsOutput(&config.Outputs[i], collector).run(ctx)
+	}
 
-	// Unversioned, no backwards compatibility guarantees for now
-	mux.HandleFunc("/api/sysinfo/all", func(w http.ResponseWriter, r *http.Request) {
-		if !isAuthorized(r, w) {
-			return
+	// Outputs that need to say goodbye before the agent exits
+	var outputs sync.WaitGroup
+
+	if config.MQTT.Broker != "" {
+		publisher, err := newMQTTPublisher(&config.MQTT, agentID(config.path), collector)
+		if err != nil {
+			return err
 		}
 
-		cachedSystemInfo.mu.Lock()
-		defer cachedSystemInfo.mu.Unlock()
+		outputs.Add(1)
+		go func() {
+			defer outputs.Done()
+			publisher.run(ctx)
+		}()
+	}
 
-		if time.Since(cachedSystemInfo.lastUpdate) > 1*time.Second {
-			info, errs := sysinfo.Collect(config.SystemInfoRequest)
-			// Behind logDebug in the event that this gets called every second
-			// and there are a lot of errors, it could get very spammy
-			if logDebug {
-				for _, err := range errs {
-					slog.Debug("Error while collecting system info", "error", err)
-				}
-			}
+	handleSysinfo := func(w http.ResponseWriter, r *http.Request) {
+		names := sectionNames()
 
-			infoAsJson, err := json.Marshal(info)
-			if err != nil {
-				slog.Error("Could not marshal sysinfo/all request", "error", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if fields := r.URL.Query().Get("fields"); fields != "" {
+			var ok bool
+			names, ok = parseSectionNames(fields)
+			if !ok {
+				http.Error(w, "Unknown field, expected any of: "+strings.Join(sectionNames(), ", "), http.StatusBadRequest)
 				return
 			}
+		}
 
-			cachedSystemInfo.json = infoAsJson
-			cachedSystemInfo.lastUpdate = time.Now()
+		info, collectedAt := collector.get(names)
+		if checkNotModified(w, r, collectedAt, collector.interval) {
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(cachedSystemInfo.json)
-	})
+		writeJSON(w, info)
+	}
+
+	handleSection := func(w http.ResponseWriter, r *http.Request) {
+		section := findSection(r.PathValue("section"))
+		if section == nil {
+			http.NotFound(w, r)
+			return
+		}
 
-	mux.HandleFunc("/api/healthz", func(w http.ResponseWriter, r *http.Request) {
-		if !isAuthorized(r, w) {
+		info, collectedAt := collector.get([]string{section.name})
+		if checkNotModified(w, r, collectedAt, collector.interval) {
 			return
 		}
 
+		writeJSON(w, section.value(info))
+	}
+
+	handleHealthz := func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
+	}
+
+	endpoints := map[string][]endpoint{
+		endpointGroupSysinfo: {
+			{"GET " + apiPrefix + "/sysinfo/all", handleSysinfo},
+			{"GET " + apiPrefix + "/sysinfo/{section}", handleSection},
+			{"GET " + apiPrefix + "/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+				document, err := openAPIDocumentJSON()
+				if err != nil {
+					slog.Error("Could not marshal OpenAPI document", "error", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(document)
+			}},
+			// Legacy path from before the API was versioned
+			{"/api/sysinfo/all", handleSysinfo},
+		},
+		endpointGroupHealthz: {
+			{"GET " + apiPrefix + "/healthz", handleHealthz},
+			// Legacy path from before the API was versioned
+			{"/api/healthz", handleHealthz},
+		},
+		endpointGroupMetrics: {
+			{"GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+				info, collectedAt := collector.get(sectionNames())
+				if checkNotModified(w, r, collectedAt, collector.interval) {
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+				writePrometheusMetrics(w, systemInfoMetrics(info))
+			}},
+		},
+	}
+
+	if len(config.Aggregate.Agents) > 0 {
+		aggregator := newAggregator(&config.Aggregate)
+		aggregator.run(ctx)
+		endpoints[endpointGroupFleet] = aggregator.endpoints()
+	}
+
+	if config.Tunnel.URL != "" {
+		handler := newListenerHandler(&listenerConfig{Endpoints: config.Tunnel.Endpoints}, endpoints)
+		go newTunnel(&config.Tunnel, agentID(config.path), handler).run(ctx)
+	}
+
+	listenerConfigs := config.listeners()
+	listeners, err := openListeners(listenerConfigs)
+	if err != nil {
+		return err
+	}
+
+	// A listener config can have more than one listener, such as when systemd passes
+	// both an IPv4 and an IPv6 socket, and each of them reports its error on shutdown
+	listenerCount := 0
+	for _, l := range listeners {
+		listenerCount += len(l)
+	}
+
+	var servers []*http.Server
+	var addresses []string
+	serveErr := make(chan error, listenerCount)
+
+	for i := range listenerConfigs {
+		server := &http.Server{
+			Handler: newListenerHandler(&listenerConfigs[i], endpoints),
+		}
+		servers = append(servers, server)
+
+		for _, listener := range listeners[i] {
+			addresses = append(addresses, listener.Addr().String())
+			go func() {
+				serveErr <- server.Serve(listener)
+			}()
+		}
+	}
+
+	if config.MDNS.Enabled {
+		go advertiseAgent(ctx, &config.MDNS, listenerConfigs, listeners)
+	}
+
+	status := "STATUS=Listening on " + strings.Join(addresses, ", ")
+	slog.Info("Starting server", "addresses", addresses)
+	notifySystemd("READY=1", status)
+
+	if timeout := systemd.WatchdogTimeout(); timeout > 0 {
+		go keepWatchdogAlive(ctx, collector, timeout, status)
+	}
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server", "timeout", config.Server.ShutdownTimeout)
+	notifySystemd("STOPPING=1", "STATUS=Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+
+	shutdownErrs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			shutdownErrs <- server.Shutdown(shutdownCtx)
+		}()
+	}
+
+	var shutdownErr error
+	for range servers {
+		if err := <-shutdownErrs; err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+
+	outputs.Wait()
+
+	if errors.Is(shutdownErr, context.DeadlineExceeded) {
+		return fmt.Errorf("requests did not finish within %v", config.Server.ShutdownTimeout)
+	}
+
+	return shutdownErr
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	valueAsJson, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("Could not marshal response", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(valueAsJson)
+}
+
+func newListenerHandler(listener *listenerConfig, endpoints map[string][]endpoint) http.Handler {
+	mux := http.NewServeMux()
+
+	for _, group := range endpointGroups {
+		if !listener.servesEndpointGroup(group) {
+			continue
+		}
+
+		for _, e := range endpoints[group] {
+			mux.HandleFunc(e.pattern, e.handler)
+		}
+	}
+
+	handler := withCompression(mux)
+
+	if listener.Token != "" {
+		handler = withToken(listener.Token, handler)
+	}
+
+	return withCORS(&listener.CORS, handler)
+}
+
+func withToken(token string, next http.Handler) http.Handler {
+	authorizationValue := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), authorizationValue) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
 	})
+}
+
+// Only pings the watchdog while the collector keeps ticking without any collection taking
+// too long, so that systemd restarts the agent if collection gets stuck (e.g. on a hung
+// mount) but not when nothing has been asked for in a while and nothing gets collected
+func keepWatchdogAlive(ctx context.Context, collector *collector, timeout time.Duration, status string) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	stalled := false
 
-	server := http.Server{
-		Addr:    fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port),
-		Handler: mux,
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !collector.isProgressing(timeout) {
+				if !stalled {
+					slog.Warn("Collector has stalled, withholding watchdog keep-alive")
+					notifySystemd("STATUS=Collector has stalled")
+					stalled = true
+				}
+				continue
+			}
+
+			if stalled {
+				notifySystemd("WATCHDOG=1", status)
+				stalled = false
+			} else {
+				notifySystemd("WATCHDOG=1")
+			}
+		}
 	}
+}
 
-	slog.Info("Starting server", "host", config.Server.Host, "port", config.Server.Port)
-	return server.ListenAndServe()
+func notifySystemd(state ...string) {
+	if err := systemd.Notify(state...); err != nil {
+		slog.Error("Could not notify systemd", "error", err)
+	}
 }
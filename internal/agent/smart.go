@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSMARTInterval = 30 * time.Minute
+	smartctlTimeout      = 30 * time.Second
+
+	// Returned by smartctl when a disk is skipped because it's in standby, which is otherwise
+	// 2 and can't be told apart from failing to open the device. Bits 0 and 1 of the exit
+	// status never get set together since smartctl exits right away on a command line error.
+	smartctlStandbyExitStatus = 3
+)
+
+// ATA attributes, see https://en.wikipedia.org/wiki/Self-Monitoring,_Analysis_and_Reporting_Technology#Known_ATA_S.M.A.R.T._attributes
+const (
+	smartAttributeReallocatedSectors = 5
+	smartAttributePendingSectors     = 197
+)
+
+type smartConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Found through smartctl --scan-open when empty
+	Devices []smartDeviceConfig `yaml:"devices"`
+	// smartctl doesn't get run more often than this, since the values rarely change
+	Interval time.Duration `yaml:"interval"`
+}
+
+type smartDeviceConfig struct {
+	Path string `yaml:"path"`
+	// Passed to smartctl as -d, such as sat or megaraid,0, detected by smartctl when empty
+	Type string `yaml:"type"`
+}
+
+func (c *smartConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("system.smart.interval can't be negative, got %v", c.Interval)
+	}
+
+	for i := range c.Devices {
+		if c.Devices[i].Path == "" {
+			return fmt.Errorf("system.smart.devices[%d]: path is required", i)
+		}
+	}
+
+	return nil
+}
+
+func (c *smartConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultSMARTInterval
+	}
+
+	return c.Interval
+}
+
+// Only copies the devices from the latest refresh, which happens in the background
+// every SMART interval since running smartctl can take a long time with many disks
+func (c *collector) collectSMART(info *apiSystemInfo) []error {
+	info.SMART = []apiSMARTDeviceInfo{}
+	if !c.config.SMART.Enabled {
+		return nil
+	}
+
+	devices, errs := c.smart.get()
+	if devices != nil {
+		info.SMART = devices
+	}
+
+	return errs
+}
+
+func (c *collector) refreshSMART(previous []apiSMARTDeviceInfo) ([]apiSMARTDeviceInfo, []error) {
+	var errs []error
+	devices := c.config.SMART.Devices
+	if len(devices) == 0 {
+		var err error
+		devices, err = scanSMARTDevices()
+		if errors.Is(err, exec.ErrNotFound) {
+			return []apiSMARTDeviceInfo{}, []error{errors.New("SMART is enabled but smartctl is not installed")}
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("scanning for SMART devices: %v", err))
+		}
+	}
+
+	results := make([]apiSMARTDeviceInfo, len(devices))
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = readSMARTDevice(&devices[i])
+		}()
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for i := range results {
+		device := &results[i]
+
+		if device.Standby {
+			// Keep what was read while the disk was last awake
+			if p := previousSMARTDevice(previous, device.Name); p != nil {
+				*device = *p
+				device.Standby = true
+			}
+			continue
+		}
+
+		if device.Error != "" {
+			errs = append(errs, fmt.Errorf("reading SMART data of %s: %s", device.Name, device.Error))
+			continue
+		}
+
+		device.UpdatedAt = now.Unix()
+	}
+
+	return results, errs
+}
+
+func previousSMARTDevice(previous []apiSMARTDeviceInfo, name string) *apiSMARTDeviceInfo {
+	for i := range previous {
+		if previous[i].Name == name && previous[i].UpdatedAt != 0 {
+			return &previous[i]
+		}
+	}
+
+	return nil
+}
+
+func scanSMARTDevices() ([]smartDeviceConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), smartctlTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "smartctl", "--scan-open", "--json=c").Output()
+	if err != nil && len(output) == 0 {
+		return nil, err
+	}
+
+	var scan struct {
+		Devices []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal(output, &scan); err != nil {
+		return nil, err
+	}
+
+	devices := make([]smartDeviceConfig, len(scan.Devices))
+	for i, d := range scan.Devices {
+		devices[i] = smartDeviceConfig{Path: d.Name, Type: d.Type}
+	}
+
+	return devices, nil
+}
+
+func readSMARTDevice(device *smartDeviceConfig) apiSMARTDeviceInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), smartctlTimeout)
+	defer cancel()
+
+	args := []string{"--json=c", "--all", fmt.Sprintf("--nocheck=standby,%d", smartctlStandbyExitStatus)}
+	if device.Type != "" {
+		args = append(args, "--device="+device.Type)
+	}
+	args = append(args, device.Path)
+
+	// The exit status is a bitmask which also reports problems with the
+	// disk itself, so the output gets parsed regardless of it
+	output, err := exec.CommandContext(ctx, "smartctl", args...).Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == smartctlStandbyExitStatus {
+		return apiSMARTDeviceInfo{Name: device.Path, Standby: true}
+	} else if err != nil && exitErr == nil {
+		return apiSMARTDeviceInfo{Name: device.Path, Error: err.Error()}
+	}
+
+	return parseSmartctlOutput(device.Path, output)
+}
+
+type smartctlOutput struct {
+	Smartctl struct {
+		Messages []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+		ExitStatus int `json:"exit_status"`
+	} `json:"smartctl"`
+	Device struct {
+		Protocol string `json:"protocol"`
+	} `json:"device"`
+	ModelName    string `json:"model_name"`
+	SerialNumber string `json:"serial_number"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current int `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	ATASmartAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeSmartHealthInformationLog struct {
+		PercentageUsed int    `json:"percentage_used"`
+		MediaErrors    uint64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// Parses the output of smartctl --json --all, kept separate from
+// running it so that it can be fed output recorded from other disks
+func parseSmartctlOutput(path string, output []byte) apiSMARTDeviceInfo {
+	device := apiSMARTDeviceInfo{Name: path}
+
+	var parsed smartctlOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		device.Error = fmt.Sprintf("parsing smartctl output: %v", err)
+		return device
+	}
+
+	// Bits 0 and 1 mean that the command line was invalid or the device couldn't be opened
+	if parsed.Smartctl.ExitStatus&0b11 != 0 {
+		device.Error = fmt.Sprintf("smartctl exited with status %d", parsed.Smartctl.ExitStatus)
+		for _, m := range parsed.Smartctl.Messages {
+			if m.Severity == "error" {
+				device.Error = m.String
+				break
+			}
+		}
+		if strings.Contains(device.Error, "Permission denied") {
+			device.Error += ", the agent needs to run as root or have the CAP_SYS_RAWIO and CAP_SYS_ADMIN capabilities"
+		}
+		return device
+	}
+
+	device.Protocol = parsed.Device.Protocol
+	device.Model = parsed.ModelName
+	device.Serial = parsed.SerialNumber
+	device.PowerOnHours = parsed.PowerOnTime.Hours
+
+	if parsed.SmartStatus != nil {
+		device.HealthIsAvailable = true
+		device.Healthy = parsed.SmartStatus.Passed
+	}
+
+	if parsed.Temperature != nil && parsed.Temperature.Current > 0 {
+		device.TemperatureIsAvailable = true
+		device.TemperatureC = uint8(min(parsed.Temperature.Current, 255))
+	}
+
+	for _, attribute := range parsed.ATASmartAttributes.Table {
+		switch attribute.ID {
+		case smartAttributeReallocatedSectors:
+			device.ReallocatedSectors = attribute.Raw.Value
+		case smartAttributePendingSectors:
+			device.PendingSectors = attribute.Raw.Value
+		}
+	}
+
+	if device.Protocol == "NVMe" {
+		device.NVMeUsedPercent = uint8(min(parsed.NVMeSmartHealthInformationLog.PercentageUsed, 255))
+		device.NVMeMediaErrors = parsed.NVMeSmartHealthInformationLog.MediaErrors
+	}
+
+	return device
+}
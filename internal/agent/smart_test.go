@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSmartctlOutput(t *testing.T) {
+	tests := []struct {
+		file string
+		path string
+		want apiSMARTDeviceInfo
+	}{
+		{
+			file: "ata.json",
+			path: "/dev/sda",
+			want: apiSMARTDeviceInfo{
+				Name:                   "/dev/sda",
+				Protocol:               "ATA",
+				Model:                  "WDC WD40EFRX-68N32N0",
+				Serial:                 "WD-WCC7K1234567",
+				HealthIsAvailable:      true,
+				Healthy:                true,
+				TemperatureIsAvailable: true,
+				TemperatureC:           34,
+				PowerOnHours:           28102,
+				ReallocatedSectors:     8,
+				PendingSectors:         2,
+			},
+		},
+		{
+			file: "nvme.json",
+			path: "/dev/nvme0",
+			want: apiSMARTDeviceInfo{
+				Name:                   "/dev/nvme0",
+				Protocol:               "NVMe",
+				Model:                  "Samsung SSD 980 PRO 1TB",
+				Serial:                 "S5GXNF0R123456A",
+				HealthIsAvailable:      true,
+				Healthy:                true,
+				TemperatureIsAvailable: true,
+				TemperatureC:           41,
+				PowerOnHours:           9417,
+				NVMeUsedPercent:        3,
+				NVMeMediaErrors:        1,
+			},
+		},
+		{
+			// Exit status 8 only means that the disk is failing, which still has to be reported
+			file: "failing.json",
+			path: "/dev/sdb",
+			want: apiSMARTDeviceInfo{
+				Name:               "/dev/sdb",
+				Protocol:           "ATA",
+				Model:              "ST2000DM001-1CH164",
+				Serial:             "Z1E5ABCD",
+				HealthIsAvailable:  true,
+				Healthy:            false,
+				PowerOnHours:       41877,
+				ReallocatedSectors: 3928,
+				PendingSectors:     184,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "smartctl", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := parseSmartctlOutput(test.path, output); got != test.want {
+				t.Errorf("got\n%+v\nwant\n%+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSmartctlOutputErrors(t *testing.T) {
+	output, err := os.ReadFile(filepath.Join("testdata", "smartctl", "permission-denied.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := parseSmartctlOutput("/dev/sda", output)
+	if !strings.HasPrefix(device.Error, "Smartctl open device: /dev/sda failed: Permission denied") ||
+		!strings.Contains(device.Error, "CAP_SYS_RAWIO") {
+		t.Errorf("unexpected error: %q", device.Error)
+	}
+	if device.HealthIsAvailable || device.Model != "" {
+		t.Errorf("expected no values to be set, got %+v", device)
+	}
+
+	device = parseSmartctlOutput("/dev/sda", []byte("smartctl: command not found"))
+	if !strings.HasPrefix(device.Error, "parsing smartctl output: ") {
+		t.Errorf("unexpected error: %q", device.Error)
+	}
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultStatsDPrefix = "luna_agent"
+	// Fits in a single Ethernet frame along with the IP and UDP headers
+	defaultStatsDMaxPacketSize = 1432
+)
+
+func validateStatsDOutput(c *outputConfig) error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return errors.New("address must be in the form of host:port")
+	}
+
+	if len(c.Tags) > 0 && !c.DogStatsD {
+		return errors.New("tags are only supported with dogstatsd enabled")
+	}
+
+	for key, value := range c.Tags {
+		if strings.ContainsAny(key+value, ",|#:") {
+			return errors.New("tags can't contain any of , | # :")
+		}
+	}
+
+	if c.MaxPacketSize < 0 {
+		return errors.New("max-packet-size can't be negative")
+	}
+
+	return nil
+}
+
+// Sends each metric as a gauge over UDP, packing as many as fit into each datagram. Names are
+// built the same way as for Graphite unless DogStatsD is enabled, in which case the hostname
+// and labels are sent as tags instead, e.g. luna_agent.disk_used_percent:41.2|g|#host:myserver,mountpoint:/
+type statsDWriter struct {
+	address       string
+	prefix        string
+	dogStatsD     bool
+	maxPacketSize int
+	// Already formatted as key:value pairs
+	tags []string
+}
+
+func newStatsDWriter(c *outputConfig) metricsWriter {
+	w := &statsDWriter{
+		address:       c.Address,
+		prefix:        strings.TrimSuffix(c.Prefix, "."),
+		dogStatsD:     c.DogStatsD,
+		maxPacketSize: c.MaxPacketSize,
+	}
+
+	if w.prefix == "" {
+		w.prefix = defaultStatsDPrefix
+	}
+
+	if w.maxPacketSize == 0 {
+		w.maxPacketSize = defaultStatsDMaxPacketSize
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(c.Tags)) {
+		w.tags = append(w.tags, key+":"+c.Tags[key])
+	}
+
+	return w
+}
+
+func (w *statsDWriter) write(ctx context.Context, samples []metricsSample) error {
+	// Only ever given the latest sample, since gauges don't carry a
+	// timestamp and older ones would get overwritten by it anyway
+	sample := &samples[len(samples)-1]
+
+	prefix := w.prefix + "."
+	if sample.hostname != "" && !w.dogStatsD {
+		prefix += metricPathSegment(sample.hostname) + "."
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", w.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet []byte
+	for i := range sample.metrics {
+		m := &sample.metrics[i]
+		if m.isInfo() && !w.dogStatsD {
+			continue
+		}
+
+		line := w.line(prefix, sample.hostname, m)
+
+		if len(packet) > 0 && len(packet)+1+len(line) > w.maxPacketSize {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+
+	if len(packet) > 0 {
+		_, err = conn.Write(packet)
+	}
+
+	return err
+}
+
+func (w *statsDWriter) line(prefix, hostname string, m *metric) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+
+	if w.dogStatsD {
+		b.WriteString(m.name)
+	} else {
+		b.WriteString(metricPath(m, "."))
+	}
+
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+	b.WriteString("|g")
+
+	if !w.dogStatsD {
+		return b.String()
+	}
+
+	tags := slices.Clone(w.tags)
+	if hostname != "" {
+		tags = append(tags, "host:"+statsDTagEscaper.Replace(hostname))
+	}
+	for _, l := range m.labels {
+		if l.value != "" {
+			tags = append(tags, l.name+":"+statsDTagEscaper.Replace(l.value))
+		}
+	}
+
+	if len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+
+	return b.String()
+}
+
+var statsDTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
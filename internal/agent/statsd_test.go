@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDLine(t *testing.T) {
+	m := &metric{name: "filesystem_used_percent", value: 81, labels: []metricLabel{{"path", "/mnt/data"}, {"name", ""}}}
+
+	w := newStatsDWriter(&outputConfig{}).(*statsDWriter)
+	if got, want := w.line("luna_agent.myserver.", "myserver", m), "luna_agent.myserver.filesystem_used_percent._mnt_data:81|g"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	w = newStatsDWriter(&outputConfig{DogStatsD: true, Tags: map[string]string{"site": "home"}}).(*statsDWriter)
+	if got, want := w.line("luna_agent.", "myserver", m), "luna_agent.filesystem_used_percent:81|g|#site:home,host:myserver,path:/mnt/data"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatsDOutputValidate(t *testing.T) {
+	config := &outputConfig{Type: "statsd", Address: "localhost:8125", Interval: time.Second}
+	if err := config.validate(); err == nil {
+		t.Error("expected interval to be rejected since statsd writes after every collection")
+	}
+}
+
+func TestStatsDOutputWritesEveryCollection(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	collector := newCollector(&systemConfig{Interval: 20 * time.Millisecond})
+	output := newMetricsOutput(&outputConfig{
+		Type:     "statsd",
+		Address:  conn.LocalAddr().String(),
+		Sections: []string{sectionMemory},
+	}, collector)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go output.run(ctx)
+	go collector.run(ctx)
+
+	// The hostname is part of each name even though the host section isn't written
+	hostname, _ := os.Hostname()
+	prefix := "luna_agent." + metricPathSegment(hostname) + ".memory_used_percent:"
+
+	buf := make([]byte, defaultStatsDMaxPacketSize)
+	for range 2 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if packet := string(buf[:n]); !strings.Contains(packet, prefix) || strings.Contains(packet, "cpu_") {
+			t.Errorf("expected only the memory section under the hostname, got %q", packet)
+		}
+	}
+}
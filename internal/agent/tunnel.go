@@ -0,0 +1,299 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tunnelProtocol       = "luna-tunnel"
+	tunnelDialTimeout    = 15 * time.Second
+	minTunnelBackoff     = 1 * time.Second
+	maxTunnelBackoff     = 1 * time.Minute
+	tunnelStableDuration = 1 * time.Minute
+	// The hub has to send a request at least this often, such as to the ping endpoint,
+	// otherwise the connection is considered dead and the agent reconnects
+	tunnelPingTimeout = 90 * time.Second
+)
+
+type tunnelConfig struct {
+	// The hub to connect to, tunneling is disabled when empty. Must be https.
+	URL string `yaml:"url"`
+	// Sent to the hub so that it can authenticate the agent
+	Token string `yaml:"token"`
+	// Base64 SHA-256 of the hub certificate's public key (SPKI). When set, the certificate
+	// doesn't have to be signed by a trusted CA but its key must match this.
+	HubPublicKeySHA256 string `yaml:"hub-public-key-sha256"`
+	// Which groups of endpoints the hub can request, all of them when empty
+	Endpoints []string `yaml:"endpoints"`
+}
+
+func (c *tunnelConfig) validate() error {
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("tunnel.url must be an https URL, got %q", c.URL)
+	}
+
+	if c.HubPublicKeySHA256 != "" {
+		pin, err := base64.StdEncoding.DecodeString(c.HubPublicKeySHA256)
+		if err != nil || len(pin) != sha256.Size {
+			return errors.New("tunnel.hub-public-key-sha256 must be a base64 encoded SHA-256 hash")
+		}
+	}
+
+	for _, e := range c.Endpoints {
+		if !slices.Contains(endpointGroups, e) {
+			return fmt.Errorf("tunnel: unknown endpoint group %q, expected one of: %s", e, strings.Join(endpointGroups, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Keeps a connection open to a hub, which can then make the same requests over it as
+// it would to the agent directly. After the HTTP upgrade handshake the roles reverse:
+// the hub sends plain HTTP/1.1 requests over the connection and the agent responds.
+type tunnel struct {
+	url       *url.URL
+	token     string
+	agentID   string
+	tlsConfig *tls.Config
+	handler   http.Handler
+	// Configurable for tests
+	pingTimeout time.Duration
+}
+
+func newTunnel(config *tunnelConfig, agentID string, handler http.Handler) *tunnel {
+	u, _ := url.Parse(config.URL)
+
+	mux := http.NewServeMux()
+	// Served regardless of tunnel.endpoints so that the hub can always keep the connection alive
+	mux.HandleFunc("GET "+apiPrefix+"/tunnel/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("/", handler)
+
+	t := &tunnel{
+		url:         u,
+		token:       config.Token,
+		agentID:     agentID,
+		tlsConfig:   &tls.Config{ServerName: u.Hostname()},
+		handler:     mux,
+		pingTimeout: tunnelPingTimeout,
+	}
+
+	if config.HubPublicKeySHA256 != "" {
+		pin, _ := base64.StdEncoding.DecodeString(config.HubPublicKeySHA256)
+		// The pin replaces CA verification, which allows hubs to use self-signed certificates
+		t.tlsConfig.InsecureSkipVerify = true
+		t.tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPublicKeyPin(state.PeerCertificates, pin)
+		}
+	}
+
+	return t
+}
+
+func verifyPublicKeyPin(certs []*x509.Certificate, pin []byte) error {
+	if len(certs) == 0 {
+		return errors.New("hub did not present a certificate")
+	}
+
+	hash := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	if !slices.Equal(hash[:], pin) {
+		return fmt.Errorf("hub public key does not match the pinned key, got %s", base64.StdEncoding.EncodeToString(hash[:]))
+	}
+
+	return nil
+}
+
+func (t *tunnel) run(ctx context.Context) {
+	slog.Info("Connecting to hub", "url", t.url.String(), "agent_id", t.agentID)
+	backoff := time.Duration(0)
+
+	for {
+		connectedAt := time.Now()
+		err := t.connectAndServe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(connectedAt) > tunnelStableDuration {
+			backoff = 0
+		}
+
+		backoff = min(max(2*backoff, minTunnelBackoff), maxTunnelBackoff)
+		wait := backoff + rand.N(backoff/4)
+
+		slog.Warn("Hub connection lost, reconnecting", "error", err, "retry_in", wait.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *tunnel) connectAndServe(ctx context.Context) error {
+	conn, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Connected to hub", "url", t.url.String())
+
+	listener := newSingleConnListener(conn)
+	server := &http.Server{
+		Handler: t.handler,
+		// Both cover the wait for the next request, the former for the first one, so that a
+		// connection that silently died, such as when a NAT mapping got dropped, gets noticed
+		ReadHeaderTimeout: t.pingTimeout,
+		IdleTimeout:       t.pingTimeout,
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	defer stop()
+
+	// Returns once the connection has been closed by either side
+	server.Serve(listener)
+
+	return errors.New("connection closed")
+}
+
+func (t *tunnel) connect(ctx context.Context) (net.Conn, error) {
+	port := t.url.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: tunnelDialTimeout},
+		Config:    t.tlsConfig,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.url.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, t.url.String(), nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", tunnelProtocol)
+	req.Header.Set("User-Agent", "luna-agent/"+buildVersion)
+	req.Header.Set("X-Luna-Agent-Id", t.agentID)
+	req.Header.Set("X-Luna-Tunnel-Ping-Timeout", strconv.Itoa(int(t.pingTimeout.Seconds())))
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	conn.SetDeadline(time.Now().Add(tunnelDialTimeout))
+	if err := req.Write(conn); err != nil {
+		return fail(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return fail(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), tunnelProtocol) {
+		return fail(fmt.Errorf("hub refused the connection with status code %d", resp.StatusCode))
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// The hub may have sent its first request right after the response
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Hands out a single connection to http.Server and then blocks
+// further calls to Accept until that connection gets closed
+type singleConnListener struct {
+	conn     net.Conn
+	accepted chan net.Conn
+	done     chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		done:     make(chan struct{}),
+		accepted: make(chan net.Conn, 1),
+	}
+
+	var once sync.Once
+	l.conn = &notifyingConn{Conn: conn, onClose: func() { once.Do(func() { close(l.done) }) }}
+	l.accepted <- l.conn
+
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyingConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyingConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Accepts tunnel connections the way the README tells hubs to and hands them to serve,
+// returning the hub along with the pin of its self-signed certificate's public key
+func newTestHub(t *testing.T, serve func(r *http.Request, conn net.Conn, rw *bufio.ReadWriter)) (*httptest.Server, string) {
+	hub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != tunnelProtocol {
+			http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijacking: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + tunnelProtocol + "\r\n\r\n")
+		rw.Flush()
+
+		serve(r, conn, rw)
+	}))
+	t.Cleanup(hub.Close)
+
+	hash := sha256.Sum256(hub.Certificate().RawSubjectPublicKeyInfo)
+	return hub, base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Sends a request to the agent over the tunnel and returns the response status and body
+func hubRequest(rw *bufio.ReadWriter, method, path string) (int, string, error) {
+	req, err := http.NewRequest(method, "http://agent"+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := req.Write(rw); err != nil {
+		return 0, "", err
+	}
+	if err := rw.Flush(); err != nil {
+		return 0, "", err
+	}
+
+	resp, err := http.ReadResponse(rw.Reader, req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestTunnelRoundTrip(t *testing.T) {
+	type result struct {
+		authorization string
+		agentID       string
+		helloStatus   int
+		helloBody     string
+		pingStatus    int
+		err           error
+	}
+	results := make(chan result, 1)
+
+	hub, pin := newTestHub(t, func(r *http.Request, conn net.Conn, rw *bufio.ReadWriter) {
+		res := result{authorization: r.Header.Get("Authorization"), agentID: r.Header.Get("X-Luna-Agent-Id")}
+		res.helloStatus, res.helloBody, res.err = hubRequest(rw, http.MethodGet, "/hello")
+		if res.err == nil {
+			res.pingStatus, _, res.err = hubRequest(rw, http.MethodGet, apiPrefix+"/tunnel/ping")
+		}
+		results <- res
+	})
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("GET /hello", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from the agent")
+	})
+
+	tun := newTunnel(&tunnelConfig{URL: hub.URL, Token: "secret", HubPublicKeySHA256: pin}, "agent-1", handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- tun.connectAndServe(ctx)
+	}()
+
+	var res result
+	select {
+	case res = <-results:
+	case err := <-served:
+		t.Fatalf("connection ended before the hub was done: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hub")
+	}
+
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.authorization != "Bearer secret" || res.agentID != "agent-1" {
+		t.Errorf("unexpected Authorization %q and agent ID %q", res.authorization, res.agentID)
+	}
+	if res.helloStatus != http.StatusOK || res.helloBody != "hello from the agent" {
+		t.Errorf("unexpected response %d %q", res.helloStatus, res.helloBody)
+	}
+	if res.pingStatus != http.StatusNoContent {
+		t.Errorf("expected ping to respond with 204, got %d", res.pingStatus)
+	}
+
+	// The hub closed the connection once it was done
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection to end")
+	}
+}
+
+func TestTunnelClosesWithoutPings(t *testing.T) {
+	closed := make(chan error, 1)
+
+	hub, pin := newTestHub(t, func(r *http.Request, conn net.Conn, rw *bufio.ReadWriter) {
+		// Wait for the agent to give up on the connection without sending anything
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := rw.ReadByte()
+		closed <- err
+	})
+
+	tun := newTunnel(&tunnelConfig{URL: hub.URL, HubPublicKeySHA256: pin}, "agent-1", http.NotFoundHandler())
+	tun.pingTimeout = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.connectAndServe(ctx)
+
+	err := <-closed
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("agent kept the connection open without pings")
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected the agent to close the connection, got %v", err)
+	}
+}
+
+func TestTunnelRejectsMismatchedPin(t *testing.T) {
+	hub, _ := newTestHub(t, func(r *http.Request, conn net.Conn, rw *bufio.ReadWriter) {
+		t.Error("hub accepted a connection from an agent that should have rejected its key")
+	})
+
+	otherKey := sha256.Sum256([]byte("some other key"))
+	pin := base64.StdEncoding.EncodeToString(otherKey[:])
+
+	tun := newTunnel(&tunnelConfig{URL: hub.URL, HubPublicKeySHA256: pin}, "agent-1", http.NotFoundHandler())
+
+	conn, err := tun.connect(context.Background())
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected connecting to fail")
+	}
+	if !strings.Contains(err.Error(), "does not match the pinned key") {
+		t.Errorf("expected a pin mismatch error, got %v", err)
+	}
+}
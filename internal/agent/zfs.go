@@ -0,0 +1,309 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zpool status can hang for a long time when a pool has failing disks
+const zfsCommandTimeout = 5 * time.Second
+
+const zfsKstatDir = "/proc/spl/kstat/zfs"
+
+const defaultZFSInterval = 10 * time.Second
+
+type zfsConfig struct {
+	// Reports all mounted datasets of a pool as a single mountpoint using the space of the pool
+	CollapseDatasets bool `yaml:"collapse-datasets"`
+	// How often zpool and zfs are run, since they can take a while on busy pools
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c *zfsConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("system.zfs.interval can't be negative, got %v", c.Interval)
+	}
+
+	return nil
+}
+
+func (c *zfsConfig) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultZFSInterval
+	}
+
+	return c.Interval
+}
+
+// Only copies the pools from the latest refresh, which happens in the background every ZFS interval
+func (c *collector) collectZFS(info *apiSystemInfo) []error {
+	pools, errs := c.zfsPools.get()
+	info.ZFS = pools
+	if info.ZFS == nil {
+		info.ZFS = []apiZFSPoolInfo{}
+	}
+
+	return errs
+}
+
+func refreshZFSPools([]apiZFSPoolInfo) ([]apiZFSPoolInfo, []error) {
+	pools := []apiZFSPoolInfo{}
+
+	// Only exist on Linux, where they let us report the state of pools even if zpool isn't installed
+	states := readZFSKstatStates()
+
+	output, err := runZFSCommand("zpool", "list", "-H", "-p", "-o", "name,size,alloc,free,frag,health")
+	if errors.Is(err, exec.ErrNotFound) {
+		for _, name := range slices.Sorted(maps.Keys(states)) {
+			pools = append(pools, apiZFSPoolInfo{Name: name, State: states[name]})
+		}
+		return pools, nil
+	} else if err != nil {
+		return pools, []error{fmt.Errorf("listing ZFS pools: %v", err)}
+	}
+
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 6 {
+			continue
+		}
+
+		pool := apiZFSPoolInfo{
+			Name:                fields[0],
+			State:               fields[5],
+			CapacityIsAvailable: true,
+			SizeMB:              parseZFSNumber(fields[1]) / bytesPerMB,
+			AllocatedMB:         parseZFSNumber(fields[2]) / bytesPerMB,
+			FreeMB:              parseZFSNumber(fields[3]) / bytesPerMB,
+			// Not applicable to pools that can't be written to, in which case it's -
+			FragmentationPercent: uint8(min(parseZFSNumber(fields[4]), 100)),
+		}
+
+		if pool.SizeMB > 0 {
+			pool.UsedPercent = uint8(min(pool.AllocatedMB*100/pool.SizeMB, 100))
+		}
+
+		if state, ok := states[pool.Name]; ok {
+			pool.State = state
+		}
+
+		pools = append(pools, pool)
+	}
+
+	if len(pools) == 0 {
+		return pools, nil
+	}
+
+	output, err = runZFSCommand("zpool", "status", "-p")
+	if err != nil {
+		return pools, []error{fmt.Errorf("getting ZFS pool status: %v", err)}
+	}
+
+	statuses := parseZpoolStatus(output)
+	for i := range pools {
+		pool := &pools[i]
+		if status, ok := statuses[pool.Name]; ok {
+			pool.ScrubState = status.ScrubState
+			pool.ScrubErrors = status.ScrubErrors
+			pool.ScrubEndTime = status.ScrubEndTime
+			pool.Vdevs = status.Vdevs
+		}
+	}
+
+	return pools, nil
+}
+
+func runZFSCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), zfsCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if message := bytes.TrimSpace(stderr.Bytes()); len(message) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Returns the state of each imported pool as reported by the kernel module, nil if it isn't available
+func readZFSKstatStates() map[string]string {
+	paths, err := filepath.Glob(filepath.Join(zfsKstatDir, "*", "state"))
+	if err != nil || len(paths) == 0 {
+		return nil
+	}
+
+	states := make(map[string]string, len(paths))
+	for _, path := range paths {
+		state, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		states[filepath.Base(filepath.Dir(path))] = strings.TrimSpace(string(state))
+	}
+
+	return states
+}
+
+func parseZFSNumber(value string) uint64 {
+	n, _ := strconv.ParseUint(value, 10, 64)
+	return n
+}
+
+var (
+	zpoolScanFinishedPattern = regexp.MustCompile(`^(scrub repaired|resilvered) .* with (\d+) errors on (.+)$`)
+	zpoolScanCanceledPattern = regexp.MustCompile(`^(?:scrub|resilver) canceled on (.+)$`)
+)
+
+// Parses the output of zpool status -p, which for each pool looks like:
+//
+//	  pool: tank
+//	 state: ONLINE
+//	  scan: scrub repaired 0B in 00:01:02 with 0 errors on Sun Oct 12 00:25:24 2025
+//	config:
+//
+//		NAME        STATE     READ WRITE CKSUM
+//		tank        ONLINE       0     0     0
+//		  mirror-0  ONLINE       0     0     0
+//		    sda     ONLINE       0     0     0
+//		    sdb     ONLINE       0     0     0
+//
+//	errors: No known data errors
+func parseZpoolStatus(output []byte) map[string]*apiZFSPoolInfo {
+	pools := map[string]*apiZFSPoolInfo{}
+	var pool *apiZFSPoolInfo
+	inConfig := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if name, ok := strings.CutPrefix(trimmed, "pool: "); ok {
+			pool = &apiZFSPoolInfo{Name: name, Vdevs: []apiZFSVdevInfo{}}
+			pools[name] = pool
+			inConfig = false
+			continue
+		}
+
+		if pool == nil {
+			continue
+		}
+
+		if scan, ok := strings.CutPrefix(trimmed, "scan: "); ok {
+			parseZpoolScan(pool, scan)
+			continue
+		}
+
+		if trimmed == "config:" {
+			inConfig = true
+			continue
+		}
+
+		if !inConfig {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "errors:") {
+			inConfig = false
+			continue
+		}
+
+		// Rows of headings such as logs, cache and spares as well as available
+		// spares have fewer columns and don't carry any errors
+		fields := strings.Fields(trimmed)
+		if len(fields) < 5 || fields[0] == "NAME" || fields[0] == pool.Name {
+			continue
+		}
+
+		pool.Vdevs = append(pool.Vdevs, apiZFSVdevInfo{
+			Name:           fields[0],
+			State:          fields[1],
+			ReadErrors:     parseZFSNumber(fields[2]),
+			WriteErrors:    parseZFSNumber(fields[3]),
+			ChecksumErrors: parseZFSNumber(fields[4]),
+		})
+	}
+
+	return pools
+}
+
+func parseZpoolScan(pool *apiZFSPoolInfo, scan string) {
+	switch {
+	case scan == "none requested":
+		pool.ScrubState = "none"
+	case strings.HasPrefix(scan, "scrub in progress"):
+		pool.ScrubState = "scrubbing"
+	case strings.HasPrefix(scan, "resilver in progress"):
+		pool.ScrubState = "resilvering"
+	case strings.HasPrefix(scan, "scrub paused"):
+		pool.ScrubState = "paused"
+	default:
+		if match := zpoolScanFinishedPattern.FindStringSubmatch(scan); match != nil {
+			pool.ScrubState = "finished"
+			if match[1] == "resilvered" {
+				pool.ScrubState = "resilvered"
+			}
+			pool.ScrubErrors = parseZFSNumber(match[2])
+			pool.ScrubEndTime = parseZpoolTime(match[3])
+		} else if match := zpoolScanCanceledPattern.FindStringSubmatch(scan); match != nil {
+			pool.ScrubState = "canceled"
+			pool.ScrubEndTime = parseZpoolTime(match[1])
+		}
+	}
+}
+
+func parseZpoolTime(value string) int64 {
+	t, err := time.ParseInLocation(time.ANSIC, value, time.Local)
+	if err != nil {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+type zfsPoolUsage struct {
+	usedBytes      uint64
+	availableBytes uint64
+}
+
+// Returns the space used by all datasets of each pool and how much is left
+// for them, which unlike the size of the pool doesn't include parity
+func refreshZFSPoolUsages(map[string]zfsPoolUsage) (map[string]zfsPoolUsage, []error) {
+	output, err := runZFSCommand("zfs", "list", "-H", "-p", "-d", "0", "-o", "name,used,available")
+	if err != nil {
+		return nil, []error{fmt.Errorf("getting ZFS pool usage: %v", err)}
+	}
+
+	usages := map[string]zfsPoolUsage{}
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		usages[fields[0]] = zfsPoolUsage{
+			usedBytes:      parseZFSNumber(fields[1]),
+			availableBytes: parseZFSNumber(fields[2]),
+		}
+	}
+
+	return usages, nil
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseZpoolStatus(t *testing.T) {
+	tests := []struct {
+		file string
+		want map[string]*apiZFSPoolInfo
+	}{
+		{
+			// Rows of logs, cache and spares as well as available spares don't get reported as vdevs
+			file: "online.txt",
+			want: map[string]*apiZFSPoolInfo{
+				"backup": {
+					Name:         "backup",
+					ScrubState:   "finished",
+					ScrubEndTime: time.Date(2025, time.October, 12, 3, 36, 46, 0, time.Local).Unix(),
+					Vdevs: []apiZFSVdevInfo{
+						{Name: "raidz2-0", State: "ONLINE"},
+						{Name: "ata-WDC_WD80EFAX-68KNBN0_VAGA1AAA", State: "ONLINE"},
+						{Name: "ata-WDC_WD80EFAX-68KNBN0_VAGA1BBB", State: "ONLINE"},
+						{Name: "ata-WDC_WD80EFAX-68KNBN0_VAGA1CCC", State: "ONLINE"},
+						{Name: "ata-WDC_WD80EFAX-68KNBN0_VAGA1DDD", State: "ONLINE"},
+						{Name: "nvme0n1p1", State: "ONLINE"},
+						{Name: "nvme0n1p2", State: "ONLINE"},
+					},
+				},
+				"rpool": {
+					Name:       "rpool",
+					ScrubState: "none",
+					Vdevs: []apiZFSVdevInfo{
+						{Name: "nvme1n1p3", State: "ONLINE"},
+					},
+				},
+			},
+		},
+		{
+			file: "degraded.txt",
+			want: map[string]*apiZFSPoolInfo{
+				"tank": {
+					Name:         "tank",
+					ScrubState:   "finished",
+					ScrubErrors:  3,
+					ScrubEndTime: time.Date(2025, time.October, 5, 1, 26, 27, 0, time.Local).Unix(),
+					Vdevs: []apiZFSVdevInfo{
+						{Name: "mirror-0", State: "DEGRADED"},
+						{Name: "sda", State: "ONLINE", ChecksumErrors: 3},
+						{Name: "11083422459227196203", State: "UNAVAIL"},
+						{Name: "mirror-1", State: "ONLINE"},
+						{Name: "sdc", State: "ONLINE", ReadErrors: 2, WriteErrors: 1},
+						{Name: "sdd", State: "ONLINE"},
+					},
+				},
+			},
+		},
+		{
+			file: "resilvering.txt",
+			want: map[string]*apiZFSPoolInfo{
+				"tank": {
+					Name:       "tank",
+					ScrubState: "resilvering",
+					Vdevs: []apiZFSVdevInfo{
+						{Name: "raidz1-0", State: "DEGRADED"},
+						{Name: "sda", State: "ONLINE"},
+						{Name: "replacing-1", State: "DEGRADED"},
+						{Name: "sdb", State: "FAULTED", ReadErrors: 12},
+						{Name: "sde", State: "ONLINE"},
+						{Name: "sdc", State: "ONLINE"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "zpool", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := parseZpoolStatus(output)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d pools, want %d", len(got), len(test.want))
+			}
+
+			for name, want := range test.want {
+				if !reflect.DeepEqual(got[name], want) {
+					t.Errorf("pool %s:\ngot  %+v\nwant %+v", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseZpoolScan(t *testing.T) {
+	tests := []struct {
+		scan      string
+		wantState string
+		wantEnd   int64
+	}{
+		{"scrub in progress since Sat Oct 18 09:14:03 2025", "scrubbing", 0},
+		{"scrub paused since Sat Oct 18 09:14:03 2025", "paused", 0},
+		{
+			"resilvered 285616865280 in 02:31:10 with 0 errors on Sat Oct 18 11:45:13 2025",
+			"resilvered",
+			time.Date(2025, time.October, 18, 11, 45, 13, 0, time.Local).Unix(),
+		},
+		{
+			"scrub canceled on Sat Oct 18 10:00:00 2025",
+			"canceled",
+			time.Date(2025, time.October, 18, 10, 0, 0, 0, time.Local).Unix(),
+		},
+		{"something a newer version might report", "", 0},
+	}
+
+	for _, test := range tests {
+		var pool apiZFSPoolInfo
+		parseZpoolScan(&pool, test.scan)
+
+		if pool.ScrubState != test.wantState || pool.ScrubEndTime != test.wantEnd {
+			t.Errorf("%q: got state %q and end time %d, want %q and %d",
+				test.scan, pool.ScrubState, pool.ScrubEndTime, test.wantState, test.wantEnd)
+		}
+	}
+}
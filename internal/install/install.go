@@ -2,6 +2,7 @@ package install
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"embed"
 	"errors"
@@ -10,6 +11,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -24,28 +27,37 @@ import (
 //go:embed templates
 var templatesFS embed.FS
 
-var defaultHiddenMountpoints = map[string]struct{}{
-	"/boot":        {},
-	"/boot/efi":    {},
-	"/var/hdd.log": {}, // from log2ram
+// Globs written to the config as rules hiding mountpoints, for those that match any
+// of the mountpoints on this host. The agent matches * within a single segment, like path.Match.
+var defaultHiddenMountpoints = []string{
+	"/boot",
+	"/boot/*",
+	"/var/hdd.log", // from log2ram
 }
 
 type installOptions struct {
-	InstallDirectory    string
-	BinaryPath          string
-	ConfigPath          string
-	ServicePath         string
-	ServiceName         string
-	UninstallScriptPath string
-	UpdateScriptPath    string
+	InstallDirectory      string
+	BinaryPath            string
+	ConfigPath            string
+	ServicePath           string
+	ServiceName           string
+	SocketPath            string
+	SocketName            string
+	UninstallScriptPath   string
+	UpdateScriptPath      string
+	AgentIDPath           string
 	LocalAddress          string
 	Hostname              string
 	AuthToken             string
 	Port                  uint16
+	UnixSocketPath        string
+	UnixSocketGroup       string
 	HiddenMountpoints     []string
 	AddFirewallRule       bool
 	EnableAndRunService   bool
 	RandomAuthToken       bool
+	SocketActivation      bool
+	AdvertiseOverMDNS     bool
 	UsingCustomConfigPath bool
 }
 
@@ -140,6 +152,7 @@ func Init() (err error) {
 	}
 
 	var serviceTemplate = mustParseTemplate("luna-agent.service")
+	var socketTemplate = mustParseTemplate("luna-agent.socket")
 	var configTemplate = mustParseTemplate("agent.yml")
 	var configEntryTemplate = mustParseTemplate("luna-entry.yml")
 	var updateScriptTemplate = mustParseTemplate("update.sh")
@@ -228,6 +241,46 @@ func Init() (err error) {
 				return nil
 			}
 		},
+		func(o *installOptions) (string, string, func() error) {
+			value := "No"
+			if o.UnixSocketPath != "" {
+				value = o.UnixSocketPath
+				if o.UnixSocketGroup != "" {
+					value += " (accessible to group " + o.UnixSocketGroup + ")"
+				}
+			}
+
+			return "Listen on a Unix socket instead of a TCP port", value, func() error {
+				input := takeUserInput(fmt.Sprintf(
+					"Enter the path of the socket such as /run/luna-agent.sock, %s to listen on the TCP port or leave blank to go back without making changes",
+					styledInputOption("no"),
+				))
+				if input == "" {
+					return nil
+				}
+
+				if strings.ToLower(input) == "no" || strings.ToLower(input) == "n" {
+					o.UnixSocketPath = ""
+					o.UnixSocketGroup = ""
+					return nil
+				}
+
+				if !filepath.IsAbs(input) {
+					return fmt.Errorf("the socket path must be absolute: %s", input)
+				}
+
+				group := takeUserInput("Enter the group whose members can connect to the socket, such as the one luna runs as, or leave blank to only allow root")
+				if group != "" {
+					if _, err := user.LookupGroup(group); err != nil {
+						return fmt.Errorf("unknown group: %s", group)
+					}
+				}
+
+				o.UnixSocketPath = input
+				o.UnixSocketGroup = group
+				return nil
+			}
+		},
 		func(o *installOptions) (string, string, func() error) {
 			return "Use a randomly generated authentication token", ternary(o.RandomAuthToken, "Yes", "No"), func() error {
 				input := takeUserInput(fmt.Sprintf(
@@ -243,6 +296,40 @@ func Init() (err error) {
 				return nil
 			}
 		},
+		func(o *installOptions) (string, string, func() error) {
+			return "Create a socket unit for systemd socket activation", ternary(o.SocketActivation, "Yes", "No"), func() error {
+				input := takeUserInput(fmt.Sprintf(
+					"Enter %s to have systemd listen on the port and pass the socket to the agent, %s to have the agent listen itself or leave blank to go back without making changes",
+					styledInputOption("yes"),
+					styledInputOption("no"),
+				))
+				if input == "" {
+					return nil
+				}
+
+				o.SocketActivation = stringToBool(input)
+				return nil
+			}
+		},
+		func(o *installOptions) (string, string, func() error) {
+			if o.UnixSocketPath != "" {
+				return "Advertise the agent on the local network over mDNS", "No (listening on a Unix socket)", nil
+			}
+
+			return "Advertise the agent on the local network over mDNS", ternary(o.AdvertiseOverMDNS, "Yes", "No"), func() error {
+				input := takeUserInput(fmt.Sprintf(
+					"Enter %s to make the agent discoverable with agent discover, %s to keep it disabled or leave blank to go back without making changes",
+					styledInputOption("yes"),
+					styledInputOption("no"),
+				))
+				if input == "" {
+					return nil
+				}
+
+				o.AdvertiseOverMDNS = stringToBool(input)
+				return nil
+			}
+		},
 	}
 
 	hasUFW := false
@@ -252,7 +339,14 @@ func Init() (err error) {
 
 	if hasUFW {
 		installOptionHandlers = append(installOptionHandlers, func(o *installOptions) (string, string, func() error) {
+			if o.UnixSocketPath != "" {
+				return "Add firewall rules", "No (listening on a Unix socket)", nil
+			}
+
 			message := "Run " + trm.Styledf("ufw allow %d/tcp", trm.FgCyan)(o.Port)
+			if o.AdvertiseOverMDNS {
+				message += " and " + trm.Styled("ufw allow 5353/udp", trm.FgCyan)
+			}
 			return message, ternary(o.AddFirewallRule, "Yes", "No"), func() error {
 				input := takeUserInput(fmt.Sprintf(
 					"Enter %s to add a firewall rule for the port, %s to skip this step or leave blank to go back without making changes",
@@ -271,7 +365,11 @@ func Init() (err error) {
 
 	installOptionHandlers = append(installOptionHandlers, func(o *installOptions) (string, string, func() error) {
 		serviceName := strings.TrimSuffix(filepath.Base(o.ServicePath), ".service")
-		message := "Run " + trm.Styled("systemctl enable --now "+serviceName, trm.FgCyan)
+		units := serviceName
+		if o.SocketActivation {
+			units = serviceName + ".socket " + serviceName
+		}
+		message := "Run " + trm.Styled("systemctl enable --now "+units, trm.FgCyan)
 		return message, ternary(o.EnableAndRunService, "Yes", "No"), func() error {
 			input := takeUserInput(fmt.Sprintf(
 				"Enter %s to enable and start the service, %s to skip this step or leave blank to go back without making changes",
@@ -297,9 +395,12 @@ func Init() (err error) {
 
 	diskPartitions, err := disk.Partitions(false)
 	if err == nil {
-		for _, partition := range diskPartitions {
-			if _, ok := defaultHiddenMountpoints[partition.Mountpoint]; ok {
-				options.HiddenMountpoints = append(options.HiddenMountpoints, partition.Mountpoint)
+		for _, pattern := range defaultHiddenMountpoints {
+			for _, partition := range diskPartitions {
+				if matched, _ := path.Match(pattern, partition.Mountpoint); matched {
+					options.HiddenMountpoints = append(options.HiddenMountpoints, pattern)
+					break
+				}
 			}
 		}
 	}
@@ -333,6 +434,12 @@ func Init() (err error) {
 		options.AuthToken = makeRandomString(32)
 	}
 
+	// Neither apply to Unix sockets, which can only be reached from this host
+	if options.UnixSocketPath != "" {
+		options.AddFirewallRule = false
+		options.AdvertiseOverMDNS = false
+	}
+
 	if !options.UsingCustomConfigPath {
 		options.ConfigPath = filepath.Join(options.InstallDirectory, "agent.yml")
 	}
@@ -340,11 +447,16 @@ func Init() (err error) {
 	options.BinaryPath = filepath.Join(options.InstallDirectory, "agent")
 	options.UninstallScriptPath = filepath.Join(options.InstallDirectory, "uninstall.sh")
 	options.UpdateScriptPath = filepath.Join(options.InstallDirectory, "update.sh")
+	// Kept next to the config by the agent
+	options.AgentIDPath = filepath.Join(filepath.Dir(options.ConfigPath), "agent-id")
 	options.ServiceName = filepath.Base(options.ServicePath)
+	options.SocketPath = strings.TrimSuffix(options.ServicePath, ".service") + ".socket"
+	options.SocketName = filepath.Base(options.SocketPath)
 
 	fmt.Println()
 
 	var serviceFileContents []byte
+	var socketFileContents []byte
 	var configFileContents []byte
 	var lunaConfigEntryContents []byte
 	var updateScriptFileContents []byte
@@ -360,6 +472,13 @@ func Init() (err error) {
 			return fail(err)
 		}
 
+		if options.SocketActivation {
+			socketFileContents, err = socketTemplate(options)
+			if err != nil {
+				return fail(err)
+			}
+		}
+
 		configFileContents, err = configTemplate(options)
 		if err != nil {
 			return fail(err)
@@ -409,6 +528,12 @@ func Init() (err error) {
 			return fail(err)
 		}
 
+		if options.SocketActivation {
+			if err := createFileIfNotExists(options.SocketPath, socketFileContents, 0644); err != nil {
+				return fail(err)
+			}
+		}
+
 		if err := copyFileFromTo(currentPathOfBinary, options.BinaryPath, 0755); err != nil {
 			return fail(err)
 		}
@@ -437,13 +562,25 @@ func Init() (err error) {
 				return trm.Styled("FAILED ("+err.Error()+")", trm.FgRed), errors.New(stderr), false
 			}
 
+			if options.AdvertiseOverMDNS {
+				_, stderr, err = runCommand("ufw", "allow", "5353/udp")
+				if err != nil {
+					return trm.Styled("FAILED ("+err.Error()+")", trm.FgRed), errors.New(stderr), false
+				}
+			}
+
 			return "DONE", nil, true
 		})
 	}
 
 	if options.EnableAndRunService {
 		serviceStarted := doWithProgressIndicator("Enabling and starting service", func() (string, error, bool) {
-			_, stderr, err := runCommand("systemctl", "enable", "--now", options.ServiceName)
+			units := []string{options.ServiceName}
+			if options.SocketActivation {
+				units = []string{options.SocketName, options.ServiceName}
+			}
+
+			_, stderr, err := runCommand("systemctl", append([]string{"enable", "--now"}, units...)...)
 			if err != nil {
 				return trm.Styled("FAILED ("+err.Error()+")", trm.FgRed), errors.New(stderr), false
 			}
@@ -456,13 +593,24 @@ func Init() (err error) {
 				time.Sleep(1 * time.Second)
 				var lastErr error
 
-				req, _ := http.NewRequest("GET", "http://localhost:"+strconv.Itoa(int(options.Port))+"/api/healthz", nil)
+				client := &http.Client{Timeout: 2 * time.Second}
+				url := "http://localhost:" + strconv.Itoa(int(options.Port)) + "/api/v1/healthz"
+
+				if options.UnixSocketPath != "" {
+					client.Transport = &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							var dialer net.Dialer
+							return dialer.DialContext(ctx, "unix", options.UnixSocketPath)
+						},
+					}
+					url = "http://localhost/api/v1/healthz"
+				}
+
+				req, _ := http.NewRequest("GET", url, nil)
 				if options.RandomAuthToken {
 					req.Header.Set("Authorization", "Bearer "+options.AuthToken)
 				}
 
-				client := &http.Client{Timeout: 2 * time.Second}
-
 				for range 3 {
 					resp, err := client.Do(req)
 					if err != nil {
@@ -490,16 +638,25 @@ func Init() (err error) {
 
 	time.Sleep(500 * time.Millisecond)
 
-	if !hasUFW || !options.AddFirewallRule {
+	if options.UnixSocketPath == "" && (!hasUFW || !options.AddFirewallRule) {
 		trm.PrintStyled("\nNOTE: ", trm.FgRed)
-		fmt.Printf("You may need to manually open port %d/tcp on this server if you have a firewall\n", options.Port)
+		if options.AdvertiseOverMDNS {
+			fmt.Printf("You may need to manually open ports %d/tcp and 5353/udp on this server if you have a firewall\n", options.Port)
+		} else {
+			fmt.Printf("You may need to manually open port %d/tcp on this server if you have a firewall\n", options.Port)
+		}
 	}
 
 	fmt.Println("\nTo update the agent run", trm.Styled("sudo "+options.UpdateScriptPath, trm.FgCyan))
 	fmt.Println("\nTo uninstall the agent run", trm.Styled("sudo "+options.UninstallScriptPath, trm.FgCyan))
 
-	fmt.Print("\nAdd the following entry to your servers list in luna.yml:\n\n")
-	trm.PrintlnStyled(string(lunaConfigEntryContents), trm.FgCyan)
+	if options.UnixSocketPath != "" {
+		fmt.Println("\nThe API is served on the Unix socket, for example:")
+		trm.PrintlnStyled("\ncurl --unix-socket "+options.UnixSocketPath+" http://localhost/api/v1/sysinfo/all", trm.FgCyan)
+	} else {
+		fmt.Print("\nAdd the following entry to your servers list in luna.yml:\n\n")
+		trm.PrintlnStyled(string(lunaConfigEntryContents), trm.FgCyan)
+	}
 
 	fmt.Println()
 
@@ -1,19 +1,38 @@
 #!/bin/bash
 
 echo "Stopping and disabling the service..."
+{{- if .SocketActivation }}
+# The socket goes first, since otherwise a connection made while the service is
+# stopping would have systemd start it right back up
+systemctl disable --now {{ .SocketName }}
+{{- end }}
 systemctl disable --now {{ .ServiceName }}
 
 {{ if .AddFirewallRule }}
 echo -e "\nRemoving firewall rule..."
 ufw delete allow {{ .Port }}/tcp
+{{- if .AdvertiseOverMDNS }}
+ufw delete allow 5353/udp
+{{- end }}
 {{ end }}
 
-echo -e "\nConfirm one at a time if you want to remove the following 5 files and 1 directory [y/n]:\n"
-rm -i \
-    "{{ .ConfigPath }}" \
-    "{{ .BinaryPath }}" \
-    "{{ .ServicePath }}" \
-    "{{ .UninstallScriptPath }}" \
+files=(
+    "{{ .ConfigPath }}"
+    "{{ .BinaryPath }}"
+    "{{ .ServicePath }}"
+{{- if .SocketActivation }}
+    "{{ .SocketPath }}"
+{{- end }}
+    "{{ .UninstallScriptPath }}"
     "{{ .UpdateScriptPath }}"
+)
+
+# Created by the agent next to its config, but only once something needed its ID
+if [ -e "{{ .AgentIDPath }}" ]; then
+    files+=("{{ .AgentIDPath }}")
+fi
+
+echo -e "\nConfirm one at a time if you want to remove the following ${#files[@]} files and 1 directory [y/n]:\n"
+rm -i "${files[@]}"
 
 rm -di "{{ .InstallDirectory }}"
@@ -0,0 +1,432 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	port = 5353
+	// Set on the class of questions that ask for a unicast response
+	// and on the class of records that replace all others of their type
+	unicastResponseBit = 0x8000
+	cacheFlushBit      = 0x8000
+
+	hostTTL    = 120
+	serviceTTL = 4500
+)
+
+var groupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: port}
+
+// Lists the types of services that are advertised on the network, see RFC 6763 section 9
+var servicesName = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+
+type Service struct {
+	// Human readable name of this instance of the service, e.g. the hostname
+	Instance string
+	// Service type and protocol, e.g. _http._tcp
+	Type string
+	// Hostname without the .local suffix
+	Host string
+	Port uint16
+	// Addresses of the host, defaults to the IPv4 addresses of all network
+	// interfaces except for loopback, link-local and virtual ones
+	IPs []net.IP
+	// Key value pairs in the form of key=value
+	TXT []string
+}
+
+// Fully qualified names that the records of a service are about
+type serviceNames struct {
+	typ      dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+}
+
+func (s *Service) names() (*serviceNames, error) {
+	typ, err := dnsmessage.NewName(s.Type + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("service type %q: %w", s.Type, err)
+	}
+
+	// Dots would otherwise split the instance into multiple labels
+	instance, err := dnsmessage.NewName(strings.ReplaceAll(s.Instance, ".", "-") + "." + s.Type + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("instance %q: %w", s.Instance, err)
+	}
+
+	host, err := dnsmessage.NewName(s.Host + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("host %q: %w", s.Host, err)
+	}
+
+	return &serviceNames{typ: typ, instance: instance, host: host}, nil
+}
+
+// Advertise answers queries for the service over multicast DNS until ctx is done, at which
+// point it tells others on the network to forget about it. The service is also announced
+// when starting so that browsers that are already running learn about it right away.
+func Advertise(ctx context.Context, service *Service) error {
+	names, err := service.names()
+	if err != nil {
+		return err
+	}
+
+	// Packing is also what catches labels longer than 63 bytes, which NewName lets through
+	announcement, err := announcementPacket(service, names, false)
+	if err != nil {
+		return fmt.Errorf("packing announcement: %w", err)
+	}
+	goodbye, err := announcementPacket(service, names, true)
+	if err != nil {
+		return fmt.Errorf("packing announcement: %w", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		conn.WriteToUDP(announcement, groupAddr)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			conn.WriteToUDP(announcement, groupAddr)
+			<-ctx.Done()
+		}
+
+		conn.WriteToUDP(goodbye, groupAddr)
+		conn.Close()
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			<-done
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if err := respond(conn, service, names, buf[:n], src); err != nil {
+			cancel()
+			<-done
+			return err
+		}
+	}
+}
+
+func announcementPacket(service *Service, names *serviceNames, goodbye bool) ([]byte, error) {
+	answers := append(serviceRecords(service, names), hostRecords(service, names)...)
+
+	if goodbye {
+		for i := range answers {
+			answers[i].Header.TTL = 0
+		}
+	}
+
+	msg := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}
+
+	return msg.Pack()
+}
+
+// Only fails if the response can't be packed, queries that can't be unpacked are ignored
+func respond(conn *net.UDPConn, service *Service, names *serviceNames, packet []byte, src *net.UDPAddr) error {
+	var query dnsmessage.Message
+	if err := query.Unpack(packet); err != nil || query.Header.Response {
+		return nil
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	unicast := false
+
+	for _, q := range query.Questions {
+		matches := func(name dnsmessage.Name, types ...dnsmessage.Type) bool {
+			return strings.EqualFold(q.Name.String(), name.String()) &&
+				(q.Type == dnsmessage.TypeALL || slices.Contains(types, q.Type))
+		}
+
+		switch {
+		case matches(servicesName, dnsmessage.TypePTR):
+			answers = append(answers, servicesRecord(names))
+		case matches(names.typ, dnsmessage.TypePTR):
+			records := serviceRecords(service, names)
+			answers = append(answers, records[0])
+			additionals = append(additionals, records[1:]...)
+			additionals = append(additionals, hostRecords(service, names)...)
+		case matches(names.instance, dnsmessage.TypeSRV, dnsmessage.TypeTXT):
+			answers = append(answers, serviceRecords(service, names)[1:]...)
+			additionals = append(additionals, hostRecords(service, names)...)
+		case matches(names.host, dnsmessage.TypeA):
+			answers = append(answers, hostRecords(service, names)...)
+		default:
+			continue
+		}
+
+		if q.Class&unicastResponseBit != 0 {
+			unicast = true
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	response := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+
+	dst := groupAddr
+
+	// Queries that don't come from the mDNS port are from simple resolvers which expect
+	// a regular DNS response sent back to them directly, see RFC 6762 section 6.7
+	if src.Port != port {
+		response.Header.ID = query.Header.ID
+		response.Questions = query.Questions
+		dst = src
+	} else if unicast {
+		dst = src
+	}
+
+	packet, err := response.Pack()
+	if err != nil {
+		return fmt.Errorf("packing response: %w", err)
+	}
+
+	conn.WriteToUDP(packet, dst)
+	return nil
+}
+
+func servicesRecord(names *serviceNames) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: servicesName, Class: dnsmessage.ClassINET, TTL: serviceTTL},
+		Body:   &dnsmessage.PTRResource{PTR: names.typ},
+	}
+}
+
+// Returns the PTR, SRV and TXT records of the service, in that order
+func serviceRecords(service *Service, names *serviceNames) []dnsmessage.Resource {
+	txt := service.TXT
+	if len(txt) == 0 {
+		// A TXT record must contain at least one string, even if it's empty
+		txt = []string{""}
+	}
+
+	return []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: names.typ, Class: dnsmessage.ClassINET, TTL: serviceTTL},
+			Body:   &dnsmessage.PTRResource{PTR: names.instance},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: names.instance, Class: dnsmessage.ClassINET | cacheFlushBit, TTL: hostTTL},
+			Body:   &dnsmessage.SRVResource{Target: names.host, Port: service.Port},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: names.instance, Class: dnsmessage.ClassINET | cacheFlushBit, TTL: serviceTTL},
+			Body:   &dnsmessage.TXTResource{TXT: txt},
+		},
+	}
+}
+
+// Prefixes of the names of interfaces created by Docker, libvirt, LXC and Kubernetes network
+// plugins, whose addresses can't be reached from other machines on the network
+var virtualInterfacePrefixes = []string{"docker", "br-", "veth", "virbr", "vnet", "lxcbr", "lxdbr", "podman", "cni", "flannel", "cali", "tap"}
+
+func isVirtualInterface(name string) bool {
+	return slices.ContainsFunc(virtualInterfacePrefixes, func(prefix string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+func hostRecords(service *Service, names *serviceNames) []dnsmessage.Resource {
+	ips := service.IPs
+	if len(ips) == 0 {
+		ips = interfaceIPs()
+	}
+
+	var records []dnsmessage.Resource
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: names.host, Class: dnsmessage.ClassINET | cacheFlushBit, TTL: hostTTL},
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+		}
+	}
+
+	return records
+}
+
+func interfaceIPs() []net.IP {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			ipnet, ok := address.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			ips = append(ips, ipnet.IP)
+		}
+	}
+
+	return ips
+}
+
+type Entry struct {
+	Instance string
+	// Hostname including the .local suffix
+	Host string
+	Port uint16
+	IPs  []net.IP
+	TXT  map[string]string
+}
+
+// Browse asks for instances of the given service type on the local network and
+// returns those that responded within the timeout, ordered by their instance name.
+func Browse(ctx context.Context, serviceType string, timeout time.Duration) ([]Entry, error) {
+	typeName, err := dnsmessage.NewName(serviceType + ".local.")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: typeName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	// UDP is unreliable, so ask a second time halfway through
+	if _, err := conn.WriteToUDP(packet, groupAddr); err != nil {
+		return nil, err
+	}
+	resend := time.AfterFunc(timeout/2, func() { conn.WriteToUDP(packet, groupAddr) })
+	defer resend.Stop()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// Keyed by the lowercased name since names are case insensitive
+	instances := map[string]dnsmessage.Name{}
+	srvs := map[string]dnsmessage.SRVResource{}
+	txts := map[string][]string{}
+	ips := map[string][]net.IP{}
+
+	buf := make([]byte, 9000)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil || !response.Header.Response {
+			continue
+		}
+
+		for _, r := range append(response.Answers, response.Additionals...) {
+			name := strings.ToLower(r.Header.Name.String())
+
+			switch body := r.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if strings.EqualFold(name, typeName.String()) {
+					instances[strings.ToLower(body.PTR.String())] = body.PTR
+				}
+			case *dnsmessage.SRVResource:
+				srvs[name] = *body
+			case *dnsmessage.TXTResource:
+				txts[name] = body.TXT
+			case *dnsmessage.AResource:
+				ip := net.IP(body.A[:])
+				if !slices.ContainsFunc(ips[name], ip.Equal) {
+					ips[name] = append(ips[name], ip)
+				}
+			}
+		}
+	}
+
+	var entries []Entry
+	for instance, instanceName := range instances {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+
+		host := strings.ToLower(srv.Target.String())
+		entry := Entry{
+			Instance: strings.TrimSuffix(instanceName.String(), "."+typeName.String()),
+			Host:     strings.TrimSuffix(host, "."),
+			Port:     srv.Port,
+			IPs:      ips[host],
+			TXT:      map[string]string{},
+		}
+
+		for _, kv := range txts[instance] {
+			if key, value, ok := strings.Cut(kv, "="); ok {
+				entry.TXT[key] = value
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Instance, b.Instance)
+	})
+
+	return entries, nil
+}
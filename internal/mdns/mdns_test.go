@@ -0,0 +1,66 @@
+package mdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAnnouncementPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		wantErr bool
+	}{
+		{"valid", Service{Instance: "nas.example.com", Type: "_luna-agent._tcp", Host: "nas"}, false},
+		{"longest instance", Service{Instance: strings.Repeat("a", 63), Type: "_luna-agent._tcp", Host: "nas"}, false},
+		{"instance too long", Service{Instance: strings.Repeat("a", 64), Type: "_luna-agent._tcp", Host: "nas"}, true},
+		{"host too long", Service{Instance: "nas", Type: "_luna-agent._tcp", Host: strings.Repeat("a", 64)}, true},
+		{"name too long", Service{Instance: "nas", Type: "_luna-agent._tcp", Host: strings.Repeat("a.", 130)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.service.IPs = []net.IP{net.IPv4(192, 168, 1, 10)}
+
+			names, err := tt.service.names()
+			if err == nil {
+				_, err = announcementPacket(&tt.service, names, false)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wanted error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostRecordsUseServiceIPs(t *testing.T) {
+	service := &Service{
+		Instance: "nas",
+		Type:     "_luna-agent._tcp",
+		Host:     "nas",
+		// IPv6 addresses aren't advertised
+		IPs: []net.IP{net.IPv4(192, 168, 1, 10), net.ParseIP("fd00::10")},
+	}
+
+	names, err := service.names()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := hostRecords(service, names)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	if records[0].Header.Name.String() != "nas.local." {
+		t.Errorf("unexpected name %q", records[0].Header.Name.String())
+	}
+
+	if a, ok := records[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 168, 1, 10} {
+		t.Errorf("unexpected record %v", records[0].Body)
+	}
+}
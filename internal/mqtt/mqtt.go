@@ -0,0 +1,383 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet types of MQTT 3.1.1, shifted into the upper bits of the first byte
+const (
+	packetConnect    = 1 << 4
+	packetConnack    = 2 << 4
+	packetPublish    = 3 << 4
+	packetPuback     = 4 << 4
+	packetPubrec     = 5 << 4
+	packetPubrel     = 6 << 4
+	packetPubcomp    = 7 << 4
+	packetPingreq    = 12 << 4
+	packetPingresp   = 13 << 4
+	packetDisconnect = 14 << 4
+)
+
+const dialTimeout = 15 * time.Second
+
+type Message struct {
+	Topic   string
+	Payload []byte
+	// 0 for at most once, 1 for at least once and 2 for exactly once delivery
+	QoS    byte
+	Retain bool
+}
+
+type Options struct {
+	// In the form of host:port
+	Address string
+	// Connects over plain TCP when nil
+	TLS       *tls.Config
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Published by the broker when the connection gets lost without disconnecting first
+	Will *Message
+}
+
+// A client that only publishes, which is all the agent needs
+type Client struct {
+	conn      net.Conn
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	nextPacketID uint16
+	// Closed once the broker has acknowledged the publish with the packet ID
+	pending map[uint16]chan struct{}
+
+	done chan struct{}
+	err  error
+}
+
+// Connect opens a connection to the broker and waits for it to accept the client
+func Connect(ctx context.Context, options *Options) (*Client, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	var err error
+	if options.TLS != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: options.TLS}).DialContext(ctx, "tcp", options.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", options.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return connect(conn, options)
+}
+
+// Sends CONNECT over an open connection and waits for the broker to accept it, closing the
+// connection if it doesn't. Kept separate from dialing so that it can be used with any net.Conn.
+func connect(conn net.Conn, options *Options) (*Client, error) {
+	c := &Client{
+		conn:      conn,
+		keepAlive: options.KeepAlive,
+		pending:   map[uint16]chan struct{}{},
+		done:      make(chan struct{}),
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	reader := bufio.NewReader(conn)
+
+	if err := c.writePacket(packetConnect, connectPacket(options)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	header, body, err := readPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if header&0xf0 != packetConnack || len(body) != 2 {
+		conn.Close()
+		return nil, errors.New("broker did not respond with CONNACK")
+	}
+
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused the connection: %s", connackReason(body[1]))
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop(reader)
+	if c.keepAlive > 0 {
+		go c.pingLoop()
+	}
+
+	return c, nil
+}
+
+func connectPacket(options *Options) []byte {
+	flags := byte(0x02) // Clean session
+	if options.Will != nil {
+		flags |= 0x04 | options.Will.QoS<<3
+		if options.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if options.Username != "" {
+		flags |= 0x80
+	}
+	if options.Password != "" {
+		flags |= 0x40
+	}
+
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags) // Protocol level 4 is MQTT 3.1.1
+	b = binary.BigEndian.AppendUint16(b, uint16(options.KeepAlive/time.Second))
+	b = appendString(b, options.ClientID)
+
+	if options.Will != nil {
+		b = appendString(b, options.Will.Topic)
+		b = appendString(b, string(options.Will.Payload))
+	}
+	if options.Username != "" {
+		b = appendString(b, options.Username)
+	}
+	if options.Password != "" {
+		b = appendString(b, options.Password)
+	}
+
+	return b
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorized"
+	}
+
+	return fmt.Sprintf("return code %d", code)
+}
+
+// Publish sends the message and, unless its QoS is 0, waits for the broker to acknowledge it
+func (c *Client) Publish(ctx context.Context, msg *Message) error {
+	if msg.QoS > 2 {
+		return fmt.Errorf("invalid QoS %d", msg.QoS)
+	}
+
+	header := byte(packetPublish) | msg.QoS<<1
+	if msg.Retain {
+		header |= 0x01
+	}
+
+	body := appendString(nil, msg.Topic)
+
+	var acked chan struct{}
+	if msg.QoS > 0 {
+		var id uint16
+		id, acked = c.newPendingPublish()
+		defer c.removePendingPublish(id)
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+
+	body = append(body, msg.Payload...)
+
+	if err := c.writePacket(header, body); err != nil {
+		return err
+	}
+
+	if acked == nil {
+		return nil
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) newPendingPublish() (uint16, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Packet IDs must not be 0
+	c.nextPacketID++
+	if c.nextPacketID == 0 {
+		c.nextPacketID = 1
+	}
+
+	acked := make(chan struct{})
+	c.pending[c.nextPacketID] = acked
+	return c.nextPacketID, acked
+}
+
+func (c *Client) removePendingPublish(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) ackPublish(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if acked, exists := c.pending[id]; exists {
+		close(acked)
+		delete(c.pending, id)
+	}
+}
+
+// Done returns a channel that's closed once the connection has been lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was lost, only valid once Done is closed
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Close disconnects from the broker, which discards the will message
+func (c *Client) Close() error {
+	c.writePacket(packetDisconnect, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop(reader *bufio.Reader) {
+	var err error
+	defer func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	}()
+
+	for {
+		if c.keepAlive > 0 {
+			// The broker responds to each ping, so there should always be something to read
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+
+		var header byte
+		var body []byte
+		header, body, err = readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch header & 0xf0 {
+		case packetPuback, packetPubcomp:
+			if len(body) >= 2 {
+				c.ackPublish(binary.BigEndian.Uint16(body))
+			}
+		case packetPubrec:
+			if len(body) >= 2 {
+				if err = c.writePacket(packetPubrel|0x02, body[:2]); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writePacket(packetPingreq, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writePacket(header byte, body []byte) error {
+	packet := append([]byte{header}, appendRemainingLength(nil, len(body))...)
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	for i := 0; ; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+func appendRemainingLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,274 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The broker's end of a connection to a client under test
+type fakeBroker struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connects a client to a fake broker over an in-memory pipe, checking the CONNECT
+// packet it sends and responding with a CONNACK carrying the given return code
+func connectToFakeBroker(t *testing.T, options *Options, wantConnect []byte, returnCode byte) (*Client, *fakeBroker, error) {
+	t.Helper()
+
+	clientConn, brokerConn := net.Pipe()
+	broker := &fakeBroker{t: t, conn: brokerConn, reader: bufio.NewReader(brokerConn)}
+	t.Cleanup(func() { brokerConn.Close() })
+
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+
+		header, body := broker.read()
+		if header != packetConnect {
+			t.Errorf("expected CONNECT, got packet type %#x", header)
+		}
+		if !bytes.Equal(body, wantConnect) {
+			t.Errorf("unexpected CONNECT body:\ngot  %q\nwant %q", body, wantConnect)
+		}
+
+		broker.write([]byte{packetConnack, 2, 0, returnCode})
+	}()
+
+	client, err := connect(clientConn, options)
+	<-connected
+	if client != nil {
+		t.Cleanup(func() { client.conn.Close() })
+	}
+
+	return client, broker, err
+}
+
+// Reports errors rather than stopping the test since it also gets called from the broker's goroutine
+func (b *fakeBroker) read() (byte, []byte) {
+	b.t.Helper()
+
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, body, err := readPacket(b.reader)
+	if err != nil {
+		b.t.Errorf("reading packet: %v", err)
+	}
+
+	return header, body
+}
+
+func (b *fakeBroker) write(packet []byte) {
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.conn.Write(packet); err != nil {
+		b.t.Errorf("writing packet: %v", err)
+	}
+}
+
+// Returns the big endian length prefix followed by s, which is how MQTT encodes strings
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestConnect(t *testing.T) {
+	options := &Options{
+		ClientID:  "luna-agent-1",
+		Username:  "user",
+		Password:  "pass",
+		KeepAlive: time.Minute,
+		Will:      &Message{Topic: "luna-agent/nas/status", Payload: []byte("offline"), QoS: 1, Retain: true},
+	}
+
+	want := concat(
+		mqttString("MQTT"),
+		// Protocol level 4, then flags for username, password, will retain, will QoS 1, will and clean session
+		[]byte{4, 0b11101110},
+		// Keep alive of 60 seconds
+		[]byte{0, 60},
+		mqttString("luna-agent-1"),
+		mqttString("luna-agent/nas/status"),
+		mqttString("offline"),
+		mqttString("user"),
+		mqttString("pass"),
+	)
+
+	if _, _, err := connectToFakeBroker(t, options, want, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	options := &Options{ClientID: "luna-agent-1"}
+	want := concat(mqttString("MQTT"), []byte{4, 0b00000010, 0, 0}, mqttString("luna-agent-1"))
+
+	_, _, err := connectToFakeBroker(t, options, want, 4)
+	if err == nil || !strings.Contains(err.Error(), "bad username or password") {
+		t.Errorf("expected the connection to be refused, got %v", err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	options := &Options{ClientID: "c"}
+	client, broker, err := connectToFakeBroker(t, options, concat(mqttString("MQTT"), []byte{4, 2, 0, 0}, mqttString("c")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("QoS 0 with a remaining length above 127", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("x"), 200)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- client.Publish(ctx, &Message{Topic: "a/b", Payload: payload, Retain: true})
+		}()
+
+		// Read the raw bytes to check the encoding of the remaining length itself
+		broker.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		fixedHeader := make([]byte, 3)
+		if _, err := io.ReadFull(broker.reader, fixedHeader); err != nil {
+			t.Fatal(err)
+		}
+		// 2 + 3 for the topic and 200 for the payload is 205, which is 0x4d with a continuation bit followed by 1
+		if want := []byte{packetPublish | 0x01, 0x4d | 0x80, 0x01}; !bytes.Equal(fixedHeader, want) {
+			t.Errorf("got fixed header %#v, want %#v", fixedHeader, want)
+		}
+
+		body := make([]byte, 205)
+		if _, err := io.ReadFull(broker.reader, body); err != nil {
+			t.Fatal(err)
+		}
+		if want := concat(mqttString("a/b"), payload); !bytes.Equal(body, want) {
+			t.Errorf("unexpected PUBLISH body %q", body)
+		}
+
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("QoS 1 waits for PUBACK", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- client.Publish(ctx, &Message{Topic: "a", Payload: []byte("1"), QoS: 1})
+		}()
+
+		header, body := broker.read()
+		if header != packetPublish|1<<1 {
+			t.Errorf("got header %#x", header)
+		}
+		if want := concat(mqttString("a"), []byte{0, 1}, []byte("1")); !bytes.Equal(body, want) {
+			t.Errorf("got body %q, want %q", body, want)
+		}
+
+		select {
+		case err := <-errs:
+			t.Fatalf("returned before PUBACK with %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// An acknowledgement of a packet ID that isn't pending gets ignored
+		broker.write([]byte{packetPuback, 2, 0, 9})
+		broker.write([]byte{packetPuback, 2, 0, 1})
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("QoS 2 answers PUBREC with PUBREL and waits for PUBCOMP", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- client.Publish(ctx, &Message{Topic: "a", Payload: []byte("2"), QoS: 2})
+		}()
+
+		header, body := broker.read()
+		if header != packetPublish|2<<1 {
+			t.Errorf("got header %#x", header)
+		}
+		if want := concat(mqttString("a"), []byte{0, 2}, []byte("2")); !bytes.Equal(body, want) {
+			t.Errorf("got body %q, want %q", body, want)
+		}
+
+		broker.write([]byte{packetPubrec, 2, 0, 2})
+
+		header, body = broker.read()
+		if header != packetPubrel|0x02 || !bytes.Equal(body, []byte{0, 2}) {
+			t.Errorf("expected PUBREL for packet 2, got header %#x and body %v", header, body)
+		}
+
+		select {
+		case err := <-errs:
+			t.Fatalf("returned before PUBCOMP with %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		broker.write([]byte{packetPubcomp, 2, 0, 2})
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("pending publish fails when the connection is lost", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- client.Publish(ctx, &Message{Topic: "a", Payload: []byte("3"), QoS: 1})
+		}()
+
+		broker.read()
+		broker.conn.Close()
+
+		if err := <-errs; err == nil {
+			t.Error("expected an error")
+		}
+		<-client.Done()
+	})
+}
+
+func TestRemainingLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+
+	for _, test := range tests {
+		got := appendRemainingLength(nil, test.length)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("appendRemainingLength(%d) = %#v, want %#v", test.length, got, test.want)
+			continue
+		}
+
+		// Round trip the smaller ones, since readPacket allocates the whole body up front
+		if test.length > 16384 {
+			continue
+		}
+		packet := concat([]byte{packetPingresp}, got, make([]byte, test.length))
+		_, body, err := readPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || len(body) != test.length {
+			t.Errorf("readPacket of a %d byte body: got %d bytes and error %v", test.length, len(body), err)
+		}
+	}
+
+	if _, _, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{packetPingresp, 0xff, 0xff, 0xff, 0xff, 0x01}))); err == nil {
+		t.Error("expected a remaining length of more than 4 bytes to be rejected")
+	}
+}